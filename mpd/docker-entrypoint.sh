@@ -1,7 +1,9 @@
 #!/bin/sh
 
 LOGPATH=${LOGPATH:-"/mpd/logs/log"}
-[[ -p $LOGPATH ]] || exit 1
+LOGMODE=${LOGMODE:-"fifo"}
+# wait for the indexer to create the log pipe unless logging to a regular file
+[[ $LOGMODE = "file" ]] || [[ -p $LOGPATH ]] || exit 1
 
 mkdir -p \
   /mpd/cache \
@@ -80,12 +80,12 @@ const websocket = {
 
     search (state, message) {
       // console.info(message.value)
-      let results = message.value[0]
-      let start = parseInt(message.value[1])
+      let results = message.value.hits
+      let start = parseInt(message.value.start)
       // console.info('searchstart', start)
       if (results != null) {
         results.map(v => {
-          state.socket.search.splice(start, 1, v)
+          state.socket.search.splice(start, 1, Object.assign({}, v.song, { score: v.score, highlight: v.highlight }))
           start++
         })
       }
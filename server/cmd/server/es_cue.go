@@ -0,0 +1,100 @@
+//
+// index CUE sheet tracks as their own songs
+//
+
+package server
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+)
+
+// MPD lists CUE sheet tracks as virtual files under the sheet
+// e.g. dir1/test1.cue/track0001
+var cueTrackPattern = regexp.MustCompile(`(?i)^(.+\.cue)/track(\d+)$`)
+
+// split virtual track path into sheet path and 1 based track number
+func parseCueTrack(file string) (string, int, bool) {
+	m := cueTrackPattern.FindStringSubmatch(file)
+	if m == nil {
+		return "", 0, false
+	}
+
+	n, err := strconv.Atoi(m[2])
+	if err != nil || n < 1 {
+		return "", 0, false
+	}
+	return m[1], n, true
+}
+
+// cache of sheet contents so each sheet is read once per indexing run
+type cueSheets map[string][]mpd.Tags
+
+// sheet entry for a track from listplaylistinfo
+// entries are the sheet audio file with a range and tags from the sheet
+func (c cueSheets) track(sheet string, n int) (mpd.Tags, error) {
+	entries, ok := c[sheet]
+	if !ok {
+		var attrs []mpd.Attrs
+		err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+			attrs, err = conn.PlaylistContents(sheet)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range attrs {
+			entries = append(entries, mpd.NewTags(a))
+		}
+		c[sheet] = entries
+	}
+
+	if n > len(entries) {
+		return nil, nil
+	}
+	return entries[n-1], nil
+}
+
+// create song document for any file including CUE tracks
+// CUE tracks get per track TITLE and PERFORMER, sheet level REM GENRE, DATE and COMMENT
+// and a link to the sheet and the audio file they play from
+func newIndexSong(file string, tags mpd.Tags, sheets cueSheets) Song {
+	sheet, n, ok := parseCueTrack(file)
+	if !ok {
+		return newSong(file, tags)
+	}
+
+	entry, err := sheets.track(sheet, n)
+	if err != nil || entry == nil {
+		s := newSong(file, tags)
+		s.Cue = sheet
+		return s
+	}
+
+	// fill tags missing from the database entry with those from the sheet
+	merged := make(mpd.Tags)
+	for k, v := range entry {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+
+	s := newSong(file, merged)
+	s.Cue = sheet
+	s.Parent = entry.Get("file")
+
+	// track PERFORMER is the artist tag and sheet PERFORMER the album artist
+	// performer is left to a performer tag so it doesn't repeat them
+	if len(s.Artist) == 0 {
+		s.Artist = merged["albumartist"]
+	}
+	if s.Track == 0 {
+		s.Track = n
+	}
+
+	return s
+}
@@ -4,60 +4,546 @@
 
 package server
 
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+)
+
 // elasticsearch stuff
+// tags that MPD may repeat are kept as arrays
 type Song struct {
-	File     string `json:"file"`
-	Date     string `json:"date,omitempty"`
-	Duration string `json:"duration,omitempty"`
-	Composer string `json:"composer,omitempty"`
-	Album    string `json:"album,omitempty"`
-	Track    string `json:"track,omitempty"`
-	Title    string `json:"title,omitempty"`
-	Artist   string `json:"artist,omitempty"`
-	Genre    string `json:"genre,omitempty"`
+	File         string   `json:"file"`
+	Title        string   `json:"title,omitempty"`
+	Artist       []string `json:"artist,omitempty"`
+	AlbumArtist  []string `json:"albumartist,omitempty"`
+	Album        string   `json:"album,omitempty"`
+	Track        int      `json:"track,omitempty"`
+	Disc         int      `json:"disc,omitempty"`
+	Date         string   `json:"date,omitempty"`
+	Year         int      `json:"year,omitempty"`
+	Decade       int      `json:"decade,omitempty"`
+	OriginalDate string   `json:"originaldate,omitempty"`
+	Genre        []string `json:"genre,omitempty"`
+	Composer     []string `json:"composer,omitempty"`
+	Performer    []string `json:"performer,omitempty"`
+	Comment      []string `json:"comment,omitempty"`
+	Label        []string `json:"label,omitempty"`
+	Duration     float64  `json:"duration,omitempty"`
+	Format       string   `json:"format,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+
+	MusicBrainzArtistId       []string `json:"musicbrainz_artistid,omitempty"`
+	MusicBrainzAlbumId        string   `json:"musicbrainz_albumid,omitempty"`
+	MusicBrainzAlbumArtistId  []string `json:"musicbrainz_albumartistid,omitempty"`
+	MusicBrainzTrackId        string   `json:"musicbrainz_trackid,omitempty"`
+	MusicBrainzReleaseTrackId string   `json:"musicbrainz_releasetrackid,omitempty"`
+	MusicBrainzWorkId         string   `json:"musicbrainz_workid,omitempty"`
+
+	// any other tags MPD returns
+	Tags map[string][]string `json:"tags,omitempty"`
+
+	// CUE sheet and audio file of virtual CUE tracks
+	Cue    string `json:"cue,omitempty"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// tags read into Song fields or not useful to index
+var songSkipTags = map[string]struct{}{
+	"file":                       struct{}{},
+	"title":                      struct{}{},
+	"artist":                     struct{}{},
+	"albumartist":                struct{}{},
+	"album":                      struct{}{},
+	"track":                      struct{}{},
+	"disc":                       struct{}{},
+	"date":                       struct{}{},
+	"originaldate":               struct{}{},
+	"genre":                      struct{}{},
+	"composer":                   struct{}{},
+	"performer":                  struct{}{},
+	"comment":                    struct{}{},
+	"label":                      struct{}{},
+	"duration":                   struct{}{},
+	"format":                     struct{}{},
+	"last-modified":              struct{}{},
+	"musicbrainz_artistid":       struct{}{},
+	"musicbrainz_albumid":        struct{}{},
+	"musicbrainz_albumartistid":  struct{}{},
+	"musicbrainz_trackid":        struct{}{},
+	"musicbrainz_releasetrackid": struct{}{},
+	"musicbrainz_workid":         struct{}{},
+	// same as duration rounded to seconds
+	"time": struct{}{},
+	// queue and playlist position
+	"pos":   struct{}{},
+	"id":    struct{}{},
+	"range": struct{}{},
+}
+
+// create song document from MPD metadata
+func newSong(file string, tags mpd.Tags) Song {
+	s := Song{
+		File:         file,
+		Title:        tags.Get("title"),
+		Artist:       tags["artist"],
+		AlbumArtist:  tags["albumartist"],
+		Album:        tags.Get("album"),
+		Track:        parseNumber(tags.Get("track")),
+		Disc:         parseNumber(tags.Get("disc")),
+		Genre:        tags["genre"],
+		Composer:     tags["composer"],
+		Performer:    tags["performer"],
+		Comment:      tags["comment"],
+		Label:        tags["label"],
+		Duration:     parseDuration(tags),
+		Format:       tags.Get("format"),
+		LastModified: tags.Get("last-modified"),
+
+		MusicBrainzArtistId:       tags["musicbrainz_artistid"],
+		MusicBrainzAlbumId:        tags.Get("musicbrainz_albumid"),
+		MusicBrainzAlbumArtistId:  tags["musicbrainz_albumartistid"],
+		MusicBrainzTrackId:        tags.Get("musicbrainz_trackid"),
+		MusicBrainzReleaseTrackId: tags.Get("musicbrainz_releasetrackid"),
+		MusicBrainzWorkId:         tags.Get("musicbrainz_workid"),
+	}
+
+	for k, v := range tags {
+		if _, ok := songSkipTags[k]; ok {
+			continue
+		}
+		s.addTag(k, v)
+	}
+
+	// dates the mapping can't take are kept as tags
+	if date, ok := parseDate(tags.Get("date")); ok {
+		s.Date = date
+		s.Year, _ = strconv.Atoi(date[:4])
+		s.Decade = s.Year - s.Year%10
+	} else if v, ok := tags["date"]; ok {
+		s.addTag("date", v)
+	}
+
+	if date, ok := parseDate(tags.Get("originaldate")); ok {
+		s.OriginalDate = date
+	} else if v, ok := tags["originaldate"]; ok {
+		s.addTag("originaldate", v)
+	}
+
+	return s
+}
+
+func (s *Song) addTag(key string, value []string) {
+	if s.Tags == nil {
+		s.Tags = make(map[string][]string)
+	}
+	s.Tags[key] = value
+}
+
+// MPD dates are usually yyyy, yyyy-MM or yyyy-MM-dd
+// full timestamps and other separators are cut down to the date part
+// anything else is left to the tags catch-all
+var datePattern = regexp.MustCompile(`^(\d{4})(?:[-/.](\d{2})(?:[-/.](\d{2}))?)?`)
+
+func parseDate(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	m := datePattern.FindStringSubmatch(value)
+	if m == nil {
+		return "", false
+	}
+
+	// the date has to end before more digits or words e.g. 20001 or 1999foo
+	// a time may follow as in 1999-08-17T10:00
+	if rest := value[len(m[0]):]; rest != "" {
+		switch c := rest[0]; {
+		case c == 'T' && len(rest) > 1 && unicode.IsDigit(rune(rest[1])):
+		case unicode.IsDigit(rune(c)) || unicode.IsLetter(rune(c)):
+			return "", false
+		}
+	}
+
+	switch {
+	case m[3] != "":
+		if _, err := time.Parse("2006-01-02", m[1]+"-"+m[2]+"-"+m[3]); err != nil {
+			return "", false
+		}
+		return m[1] + "-" + m[2] + "-" + m[3], true
+	case m[2] != "":
+		if _, err := time.Parse("2006-01", m[1]+"-"+m[2]); err != nil {
+			return "", false
+		}
+		return m[1] + "-" + m[2], true
+	default:
+		return m[1], true
+	}
+}
+
+// track and disc numbers may be written as n/total
+func parseNumber(value string) int {
+	if i := strings.Index(value, "/"); i >= 0 {
+		value = value[:i]
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// duration in seconds with fallback to the older whole second time tag
+func parseDuration(tags mpd.Tags) float64 {
+	for _, key := range []string{"duration", "time"} {
+		if d, err := strconv.ParseFloat(tags.Get(key), 64); err == nil {
+			return d
+		}
+	}
+	return 0
+}
+
+// browse facets and the fields they count
+var esSongFacets = map[string]string{
+	"artist":      "artist.keyword",
+	"albumartist": "albumartist.keyword",
+	"album":       "album.keyword",
+	"genre":       "genre.keyword",
+	"year":        "year",
+	"decade":      "decade",
+}
+
+// fields that search results can be filtered on by value
+// suggestions carry a filter using these names
+var esSongFilters = map[string]string{
+	"title":       "title.keyword",
+	"artist":      "artist.keyword",
+	"albumartist": "albumartist.keyword",
+	"album":       "album.keyword",
+	"genre":       "genre.keyword",
+	"year":        "year",
+	"decade":      "decade",
+}
+
+// text fields searched by free text queries
+// each has exact and cjk sub fields in the mapping
+var esSongSearchFields = []string{
+	"title",
+	"artist",
+	"albumartist",
+	"album",
+	"genre",
+	"composer",
+	"performer",
+	"comment",
+	"label",
+}
+
+// field names usable in search queries as field:value
+var esSongQueryFields = query.Schema{
+	"title":        {Name: "title", Kind: query.Text},
+	"artist":       {Name: "artist", Kind: query.Text},
+	"albumartist":  {Name: "albumartist", Kind: query.Text},
+	"album":        {Name: "album", Kind: query.Text},
+	"genre":        {Name: "genre", Kind: query.Text},
+	"composer":     {Name: "composer", Kind: query.Text},
+	"performer":    {Name: "performer", Kind: query.Text},
+	"comment":      {Name: "comment", Kind: query.Text},
+	"label":        {Name: "label", Kind: query.Text},
+	"track":        {Name: "track", Kind: query.Number},
+	"disc":         {Name: "disc", Kind: query.Number},
+	"year":         {Name: "year", Kind: query.Number},
+	"decade":       {Name: "decade", Kind: query.Number},
+	"duration":     {Name: "duration", Kind: query.Number},
+	"date":         {Name: "date", Kind: query.Date},
+	"originaldate": {Name: "originaldate", Kind: query.Date},
+	"file":         {Name: "file", Kind: query.Keyword},
+	"format":       {Name: "format", Kind: query.Keyword},
+	"cue":          {Name: "cue", Kind: query.Keyword},
+	"parent":       {Name: "parent", Kind: query.Keyword},
+}
+
+// suggestion types in the order they are returned
+var esSongSuggest = []search.SuggestField{
+	{Type: "artist", Match: "artist.suggest", Value: "artist.keyword"},
+	{Type: "album", Match: "album.suggest", Value: "album.keyword"},
+	{Type: "title", Match: "title.suggest", Value: "title.keyword"},
 }
 
 const (
+	// default number of suggestions per type
+	esSongSuggestSize = 5
+
+	// default number of values returned per facet
+	esSongFacetSize = 100
+
 	esSongMapping = `
 {
 	"settings":{
 		"number_of_shards": 1,
-		"number_of_replicas": 0
+		"number_of_replicas": 0,
+		"analysis":{
+			"filter":{
+				"autocomplete_filter":{
+					"type":"edge_ngram",
+					"min_gram":1,
+					"max_gram":20
+				}
+			},
+			"analyzer":{
+				"folding":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","asciifolding"]
+				},
+				"autocomplete":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","asciifolding","autocomplete_filter"]
+				},
+				"autocomplete_search":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","asciifolding"]
+				}
+			}
+		}
 	},
 	"mappings":{
 		"song":{
+			"date_detection":false,
 			"properties":{
 				"file":{
 					"type":"keyword"
 				},
-				"date":{
-					"type":"date"
+				"title":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"keyword":{
+							"type":"keyword",
+							"ignore_above":256
+						},
+						"suggest":{
+							"type":"text",
+							"analyzer":"autocomplete",
+							"search_analyzer":"autocomplete_search"
+						},
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
 				},
-				"duration":{
-					"type":"text"
+				"artist":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"keyword":{
+							"type":"keyword",
+							"ignore_above":256
+						},
+						"suggest":{
+							"type":"text",
+							"analyzer":"autocomplete",
+							"search_analyzer":"autocomplete_search"
+						},
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
 				},
-				"composer":{
-					"type":"text"
+				"albumartist":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"keyword":{
+							"type":"keyword",
+							"ignore_above":256
+						},
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
 				},
 				"album":{
-					"type":"text"
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"keyword":{
+							"type":"keyword",
+							"ignore_above":256
+						},
+						"suggest":{
+							"type":"text",
+							"analyzer":"autocomplete",
+							"search_analyzer":"autocomplete_search"
+						},
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
 				},
 				"track":{
-					"type":"text"
+					"type":"integer"
 				},
-				"title":{
-					"type":"text"
+				"disc":{
+					"type":"integer"
 				},
-				"artist":{
-					"type":"text"
+				"date":{
+					"type":"date",
+					"format":"yyyy-MM-dd||yyyy-MM||yyyy"
+				},
+				"year":{
+					"type":"integer"
+				},
+				"decade":{
+					"type":"integer"
+				},
+				"originaldate":{
+					"type":"date",
+					"format":"yyyy-MM-dd||yyyy-MM||yyyy"
 				},
 				"genre":{
-					"type":"text"
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"keyword":{
+							"type":"keyword",
+							"ignore_above":256
+						},
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
+				},
+				"composer":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
+				},
+				"performer":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
+				},
+				"comment":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
+				},
+				"label":{
+					"type":"text",
+					"analyzer":"folding",
+					"fields":{
+						"exact":{
+							"type":"text",
+							"analyzer":"standard"
+						},
+						"cjk":{
+							"type":"text",
+							"analyzer":"cjk"
+						}
+					}
+				},
+				"duration":{
+					"type":"float"
+				},
+				"format":{
+					"type":"keyword"
+				},
+				"last_modified":{
+					"type":"date"
+				},
+				"musicbrainz_artistid":{
+					"type":"keyword"
+				},
+				"musicbrainz_albumid":{
+					"type":"keyword"
+				},
+				"musicbrainz_albumartistid":{
+					"type":"keyword"
+				},
+				"musicbrainz_trackid":{
+					"type":"keyword"
+				},
+				"musicbrainz_releasetrackid":{
+					"type":"keyword"
+				},
+				"musicbrainz_workid":{
+					"type":"keyword"
+				},
+				"tags":{
+					"type":"object",
+					"dynamic":true
+				},
+				"cue":{
+					"type":"keyword"
+				},
+				"parent":{
+					"type":"keyword"
 				}
 			}
 		}
 	}
 }`
-	esSongIndex    = "songs"
-	esSongDocument = "song"
+	// increment on mapping change to rebuild the index in the background
+	esSongMappingVersion = 4
+	esSongIndex          = "songs"
+	esSongDocument       = "song"
 )
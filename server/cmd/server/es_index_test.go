@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"1959", "1959", true},
+		{"1959-08", "1959-08", true},
+		{"1959-08-17", "1959-08-17", true},
+		{" 1959/08/17 ", "1959-08-17", true},
+		{"1959.08", "1959-08", true},
+		{"1959-08-17T10:00:00Z", "1959-08-17", true},
+		{"1959 (remaster)", "1959", true},
+		{"1959-13", "", false},
+		{"1959-02-30", "", false},
+		{"20001", "", false},
+		{"2000-13x", "", false},
+		{"2000-12x", "", false},
+		{"1999foo", "", false},
+		{"unknown", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseDate(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseDate(%q) = %q, %v, want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+//
+// reconcile full MPD library with elasticsearch index
+//
+
+package server
+
+import (
+	"time"
+
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/sirupsen/logrus"
+)
+
+// wait before retrying a failed full run
+const reconcileRetry = 30 * time.Second
+
+type Reconciler struct {
+	full   chan struct{}
+	update chan struct{}
+
+	// MPD state at last successful sync
+	dbUpdate     string
+	lastModified time.Time
+}
+
+// run full reconcile on start, every interval and when triggered
+// run incremental sync on database change
+func NewReconciler(interval time.Duration) *Reconciler {
+	r := &Reconciler{
+		full:   make(chan struct{}, 1),
+		update: make(chan struct{}, 1),
+	}
+
+	r.Trigger()
+	go r.run(interval)
+
+	return r
+}
+
+// request a full reconcile run
+// requests made while one is already pending are merged
+func (r *Reconciler) Trigger() {
+	select {
+	case r.full <- struct{}{}:
+	default:
+	}
+}
+
+// request an incremental sync of songs changed since the last run
+func (r *Reconciler) Update() {
+	select {
+	case r.update <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Reconciler) run(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		full := false
+
+		select {
+		case <-r.full:
+			full = true
+		case <-tick:
+			full = true
+		case <-r.update:
+		}
+
+		if err := r.reconcile(full); err != nil {
+			logrus.Errorf("Reconciler: Failed: %v", err)
+
+			// a backend still connecting at startup should not put off the first full run until the next interval
+			if full {
+				time.AfterFunc(reconcileRetry, r.Trigger)
+			}
+		}
+	}
+}
+
+// add songs missing from the index, reindex songs modified since the last run
+// and delete documents no longer in MPD
+// incremental runs are skipped if the MPD database has not been updated
+func (r *Reconciler) reconcile(full bool) error {
+	var stats mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		stats, err = conn.Stats()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	dbUpdate := stats["db_update"]
+	if !full && dbUpdate == r.dbUpdate {
+		logrus.Infof("Reconciler: Database unchanged since last sync")
+		return nil
+	}
+
+	// new mapping version waiting to be filled
+	if rebuilder, ok := searchIndex.(search.Rebuilder); ok && full {
+		if index := rebuilder.PendingIndex(); index != "" {
+			return r.rebuild(rebuilder, index, dbUpdate)
+		}
+	}
+
+	logrus.Infof("Reconciler: Start: full %v, db_update %s -> %s", full, r.dbUpdate, dbUpdate)
+
+	indexed := make(map[string]struct{})
+	err = searchIndex.ScrollIds(func(id string) {
+		indexed[id] = struct{}{}
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		added, updated, deleted int
+		lastModified            = r.lastModified
+		sheets                  = make(cueSheets)
+	)
+
+	err = mpdClient.ListAllInfo("", func(tags mpd.Tags) {
+		file := tags.Get("file")
+
+		modified, _ := time.Parse(time.RFC3339, tags.Get("last-modified"))
+		if modified.After(lastModified) {
+			lastModified = modified
+		}
+
+		if _, ok := indexed[file]; ok {
+			delete(indexed, file)
+
+			// nothing to compare against before the first sync
+			if r.lastModified.IsZero() || !modified.After(r.lastModified) {
+				return
+			}
+			updated++
+		} else {
+			added++
+		}
+
+		searchIndex.IndexBulk(file, newIndexSong(file, tags, sheets))
+	})
+	// a partial listing would delete songs that still exist
+	if err != nil {
+		return err
+	}
+
+	for id := range indexed {
+		searchIndex.DeleteBluk(id)
+		deleted++
+	}
+
+	r.dbUpdate = dbUpdate
+	r.lastModified = lastModified
+
+	logrus.Infof("Reconciler: Done: added %d, updated %d, deleted %d", added, updated, deleted)
+	return nil
+}
+
+// fill index for a new mapping version from MPD and switch the alias to it
+// searches keep using the old index until done
+func (r *Reconciler) rebuild(rebuilder search.Rebuilder, index, dbUpdate string) error {
+	logrus.Infof("Reconciler: Rebuild %s: Start", index)
+
+	var (
+		count        int
+		lastModified time.Time
+		sheets       = make(cueSheets)
+	)
+
+	err := mpdClient.ListAllInfo("", func(tags mpd.Tags) {
+		file := tags.Get("file")
+
+		modified, _ := time.Parse(time.RFC3339, tags.Get("last-modified"))
+		if modified.After(lastModified) {
+			lastModified = modified
+		}
+
+		rebuilder.IndexBulkTo(index, file, newIndexSong(file, tags, sheets))
+		count++
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := rebuilder.SwapAlias(); err != nil {
+		return err
+	}
+
+	r.dbUpdate = dbUpdate
+	r.lastModified = lastModified
+
+	logrus.Infof("Reconciler: Rebuild %s: Done: indexed %d", index, count)
+	return nil
+}
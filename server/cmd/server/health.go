@@ -0,0 +1,92 @@
+//
+// liveness, readiness and metrics
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/randomcoww/go-mpd-es/pkg/elasticsearch"
+	"github.com/randomcoww/go-mpd-es/pkg/metrics"
+	"github.com/randomcoww/go-mpd-es/pkg/util"
+)
+
+type healthConn struct {
+	name    string
+	state   func() util.ConnStatus
+	dropped func() map[string]uint64
+	// down does not make the server unready
+	optional bool
+}
+
+type healthResponse struct {
+	Ready       bool                       `json:"ready"`
+	Connections map[string]util.ConnStatus `json:"connections"`
+}
+
+var healthConns []healthConn
+
+// track backend connections for health checks and metrics
+func registerHealth() {
+	healthConns = []healthConn{
+		{name: "mpd", state: mpdClient.State, dropped: mpdClient.DroppedEvents},
+		{name: "mpd_event", state: mpdEvent.State, dropped: mpdEvent.DroppedEvents},
+	}
+
+	if esClient, ok := searchIndex.(*elasticsearch.EsClient); ok {
+		healthConns = append(healthConns, healthConn{
+			name:     "elasticsearch",
+			state:    esClient.State,
+			dropped:  esClient.DroppedEvents,
+			optional: *esOptional,
+		})
+
+		metrics.RegisterGauge("bulk_pending_actions", "Actions waiting for the next Elasticsearch bulk request.", esClient.BulkPending)
+		metrics.RegisterGauge("dead_letters", "Rejected index updates waiting to be replayed.", esClient.DeadLetters)
+	}
+
+	for _, c := range healthConns {
+		metrics.RegisterConn(c.name, c.state)
+		metrics.RegisterDropped(c.name, c.dropped)
+	}
+}
+
+func healthStatus() *healthResponse {
+	h := &healthResponse{
+		Ready:       true,
+		Connections: make(map[string]util.ConnStatus),
+	}
+
+	for _, c := range healthConns {
+		s := c.state()
+		h.Connections[c.name] = s
+
+		if !s.Up && !c.optional {
+			h.Ready = false
+		}
+	}
+	return h
+}
+
+// server is running
+// connection states are included but don't fail the check as restarting won't fix them
+func liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(healthStatus())
+}
+
+// all required backends are up
+func readiness(w http.ResponseWriter, r *http.Request) {
+	h := healthStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	if h.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/randomcoww/go-mpd-es/pkg/metrics"
+)
+
+// Hub maintains the set of active clients and broadcasts messages to the
+// clients.
+type Hub struct {
+	// Registered clients.
+	clients map[*Client]bool
+
+	// Inbound messages from the clients.
+	broadcast chan *socketMessage
+
+	// Register requests from the clients.
+	register chan *Client
+
+	// Unregister requests from clients.
+	unregister chan *Client
+
+	// Close all clients and refuse new ones.
+	shutdown chan struct{}
+	closed   bool
+
+	// Client writers still sending.
+	// closing is set before waiting so no writer is added after.
+	lock    sync.Mutex
+	closing bool
+	writers sync.WaitGroup
+}
+
+func newHub() *Hub {
+	return &Hub{
+		broadcast:  make(chan *socketMessage),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		shutdown:   make(chan struct{}),
+		clients:    make(map[*Client]bool),
+	}
+}
+
+func (h *Hub) run() {
+	shutdown := h.shutdown
+
+	for {
+		select {
+		case client := <-h.register:
+			if h.closed {
+				close(client.done)
+				break
+			}
+			h.clients[client] = true
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.done)
+			}
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				select {
+				case client.send <- message:
+				default:
+					metrics.WebSocketDropped.Inc()
+					close(client.done)
+					delete(h.clients, client)
+				}
+			}
+		case <-shutdown:
+			for client := range h.clients {
+				close(client.done)
+				delete(h.clients, client)
+			}
+			h.closed = true
+			// a closed channel is always ready
+			shutdown = nil
+		}
+		metrics.WebSocketClients.Set(float64(len(h.clients)))
+	}
+}
+
+// track the writer of a new client
+// returns false once the hub is closing
+func (h *Hub) addWriter() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closing {
+		return false
+	}
+	h.writers.Add(1)
+	return true
+}
+
+// send close frames to all clients and wait for them to be written until ctx is done
+// call after the server stops accepting connections
+func (h *Hub) close(ctx context.Context) {
+	h.lock.Lock()
+	h.closing = true
+	h.lock.Unlock()
+
+	close(h.shutdown)
+
+	done := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
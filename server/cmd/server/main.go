@@ -1,26 +1,49 @@
 package server
 
 import (
+	"context"
 	"flag"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/randomcoww/go-mpd-es/pkg/elasticsearch"
+	"github.com/randomcoww/go-mpd-es/pkg/memindex"
+	"github.com/randomcoww/go-mpd-es/pkg/metrics"
 	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/randomcoww/go-mpd-es/pkg/sqlite"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	listenurl = flag.String("listenurl", "", "Listen URL")
-	logFile   = flag.String("logfile", "", "MPD log file path")
-	mpdSocket = flag.String("mpdsocket", "/run/mpd/socket", "MPD Socket")
-	esUrl     = flag.String("esurl", "http://localhost:9200", "Elasticsearch URL")
+	listenurl      = flag.String("listenurl", "", "Listen URL")
+	logFile        = flag.String("logfile", "", "MPD log file path")
+	logMode        = flag.String("logmode", "fifo", "MPD log mode (fifo to create and read a named pipe or file to tail a regular log file)")
+	offsetFile     = flag.String("logoffset", "", "File to keep log read offset in when tailing a regular log file")
+	mpdProto       = flag.String("mpdproto", "unix", "MPD protocol (unix or tcp)")
+	mpdSocket      = flag.String("mpdsocket", "/run/mpd/socket", "MPD Socket")
+	esUrl          = flag.String("esurl", "http://localhost:9200", "Elasticsearch URL")
+	esOptional     = flag.Bool("esoptional", false, "Report ready while Elasticsearch is down")
+	deadLetterFile = flag.String("deadletterfile", "", "File to keep index updates Elasticsearch rejected in for replay (empty to only log them)")
+
+	searchBackend = flag.String("searchbackend", "es", "Search backend (es for Elasticsearch, memory for the embedded index or sqlite)")
+	indexPath     = flag.String("indexpath", "", "File to keep the embedded index (empty to keep it in memory only) or SQLite database (required) in")
+
+	indexMode         = flag.String("indexmode", "log", "Index mode (log to index from MPD log events or idle to sync on MPD database events)")
+	shutdownTimeout   = flag.Duration("shutdowntimeout", 20*time.Second, "Time to finish pending index updates and close connections on shutdown")
+	reconcileInterval = flag.Duration("reconcileinterval", 24*time.Hour, "Interval for full MPD and Elasticsearch reconcile (0 to disable)")
 )
 
 var (
 	mpdLogReader   *MpdLogEvents
 	mpdClient      *mpd.MpdClient
 	mpdEvent       *mpd.MpdEvent
-	esClient       *elasticsearch.EsClient
+	searchIndex    search.Backend
 	playlistStatus *PlaylistStatus
+	reconciler     *Reconciler
+	hub            *Hub
 )
 
 func Main() {
@@ -30,69 +53,203 @@ func Main() {
 		err error
 	)
 
-	exit := make(chan struct{})
+	// stops reading the MPD log and serving
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// MPD and Elasticsearch connections outlive ctx to finish pending index updates
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+
+	// idle mode indexes from MPD database events and does not need the log
+	if *indexMode == "log" {
+		switch *logMode {
+		case "file":
+			mpdLogReader, err = NewMpdLogTailer(ctx, *logFile, *offsetFile)
+		default:
+			mpdLogReader, err = NewMpdLogReader(ctx, *logFile)
+		}
+		if err != nil {
+			logrus.Errorf("Could not open MPD log, %v", err)
+			panic("Could not open MPD log")
+		}
+	}
 
-	mpdLogReader, err = NewMpdLogReader(*logFile)
-	if err != nil {
-		logrus.Errorf("Could not open MPD log, %v", err)
-		panic("Could not open MPD log")
+	mpdClient = mpd.NewMpdClient(connCtx, *mpdProto, *mpdSocket)
+	mpdEvent = mpd.NewMpdEvent(connCtx, *mpdProto, *mpdSocket)
+
+	switch *searchBackend {
+	case "memory":
+		searchIndex, err = memindex.New(*indexPath, esSongSearchFields)
+		if err != nil {
+			logrus.Errorf("Could not open index, %v", err)
+			panic("Could not open index")
+		}
+	case "sqlite":
+		// an empty path opens a separate temporary database per connection
+		if *indexPath == "" {
+			logrus.Errorf("SQLite backend needs -indexpath")
+			panic("Could not open index")
+		}
+		searchIndex, err = sqlite.New(*indexPath, esSongSearchFields)
+		if err != nil {
+			logrus.Errorf("Could not open index, %v", err)
+			panic("Could not open index")
+		}
+	default:
+		esClient := elasticsearch.NewEsClient(connCtx, *esUrl, esSongIndex, esSongDocument, esSongMapping, esSongMappingVersion)
+		esClient.SetSearchFields(esSongSearchFields...)
+		if *deadLetterFile != "" {
+			if err := esClient.SetDeadLetterFile(*deadLetterFile); err != nil {
+				logrus.Errorf("Could not open dead letter file, %v", err)
+				panic("Could not open dead letter file")
+			}
+		}
+		searchIndex = esClient
 	}
 
-	mpdClient = mpd.NewMpdClient("unix", *mpdSocket)
-	mpdEvent = mpd.NewMpdEvent("unix", *mpdSocket)
-	esClient = elasticsearch.NewEsClient(*esUrl, esSongIndex, esSongDocument, esSongMapping)
+	registerHealth()
 
-	// playlistStatus = NewPlaylistStatus()
+	playlistStatus = NewPlaylistStatus()
+	reconciler = NewReconciler(*reconcileInterval)
 
-	go runLogIndexer()
-	go runEventHandler()
+	hub = newHub()
+	go hub.run()
+
+	indexed := make(chan struct{})
+	if mpdLogReader != nil {
+		go func() {
+			runLogIndexer()
+			close(indexed)
+		}()
+	} else {
+		close(indexed)
+	}
+
+	// backends connect in the background so the server and health checks start right away
+	go func() {
+		if mpdClient.WaitReady(ctx) != nil {
+			return
+		}
+
+		// set mpd repeat by default
+		mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Repeat(true)
+		})
+		if err := playlistStatus.update(); err != nil {
+			logrus.Errorf("Server: Get playlist status: %v", err)
+		}
+
+		runEventHandler(ctx)
+	}()
+
+	server := newServer(*listenurl, hub)
+	go func() {
+		logrus.Infof("Server: Start on %s", *listenurl)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Errorf("Server: Stopped: %v", err)
+			stop()
+		}
+	}()
 
-	<-exit
+	<-ctx.Done()
+	logrus.Infof("Server: Shutdown")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// stop accepting connections before closing websocket clients
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.Errorf("Server: Shutdown: %v", err)
+	}
+	hub.close(shutdownCtx)
+
+	// log reader stopped with ctx so events it already read are indexed next
+	select {
+	case <-indexed:
+	case <-shutdownCtx.Done():
+		logrus.Errorf("Server: Shutdown: Log indexer did not finish")
+	}
+
+	if closer, ok := searchIndex.(search.Closer); ok {
+		if err := closer.Close(shutdownCtx); err != nil {
+			logrus.Errorf("Server: Shutdown: Close search index: %v", err)
+		}
+	}
+
+	closeConns()
+	mpdEvent.Close()
+	mpdClient.Close()
+
+	logrus.Infof("Server: Shutdown complete")
 }
 
-// Read mpd logs and index to ES
+// Read mpd logs and index to search backend until the reader stops
 func runLogIndexer() {
 	for {
 		select {
+		case <-mpdLogReader.Done:
+			return
 		case e := <-mpdLogReader.AddEvent:
 			logrus.Infof("Add item event: %s", e)
+			metrics.LogEvents.WithLabelValues("add").Inc()
 			attr := mpdClient.GetDatabaseItem(e)
 
 			logrus.Infof("Add item: %v", attr)
 
-			esClient.IndexBulk(e, Song{
-				File:     e,
-				Date:     attr["date"],
-				Duration: attr["duration"],
-				Composer: attr["composer"],
-				Album:    attr["album"],
-				Track:    attr["track"],
-				Title:    attr["title"],
-				Artist:   attr["artist"],
-				Genre:    attr["genre"],
-			})
+			searchIndex.IndexBulk(e, newIndexSong(e, attr, make(cueSheets)))
 		case e := <-mpdLogReader.DeleteEvent:
 			logrus.Infof("Delete item event: %s", e)
-			esClient.DeleteBluk(e)
+			metrics.LogEvents.WithLabelValues("delete").Inc()
+			searchIndex.DeleteBluk(e)
 		}
 	}
 }
 
-// handle events from MPD
-func runEventHandler() {
+// handle events from MPD and broadcast to websocket clients
+func runEventHandler(ctx context.Context) {
 	for {
 		select {
+		case <-ctx.Done():
+			return
+
 		case e := <-mpdEvent.Events:
+			metrics.IdleEvents.WithLabelValues(e).Inc()
 
 			switch e {
 			case "player":
+				broadcastMessage(createStatusMessage())
+				broadcastMessage(createCurrentSongMessage())
+				broadcastMessage(createSeekMessage())
 
 			case "playlist":
+				broadcastMessage(playlistStatus.createChangedMessage())
 
 			case "mixer", "options", "outputs":
+				broadcastMessage(createStatusMessage())
 
 			case "update":
+				broadcastMessage(createUpdateDatabaseMessage(), nil)
+
+			case "database":
+				if *indexMode == "idle" {
+					reconciler.Update()
+				}
 			}
+
+		// keep clients seek position in sync
+		case <-time.After(1000 * time.Millisecond):
+			broadcastMessage(createSeekMessage())
 		}
 	}
 }
+
+func broadcastMessage(msg *socketMessage, err error) {
+	if err != nil {
+		logrus.Errorf("Server: Create message failed: %v", err)
+		return
+	}
+	if msg != nil {
+		hub.broadcast <- msg
+	}
+}
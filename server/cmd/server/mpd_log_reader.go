@@ -6,26 +6,35 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"os"
-	"strings"
 	"syscall"
 	"time"
 
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
 	"github.com/sirupsen/logrus"
 )
 
 type MpdLogEvents struct {
 	AddEvent    chan string
 	DeleteEvent chan string
+	// closed after reading stops and the last event was received
+	Done chan struct{}
 }
 
 const (
-	logAddedString   = "update: added "
-	logDeletedString = "update: removing "
+	// poll interval for new lines when tailing a log file
+	logPollInterval = 1000 * time.Millisecond
+	// save offset after this many lines while catching up
+	logOffsetSaveLines = 100
 )
 
 // process to read log to create add and remove events
-func NewMpdLogReader(logFile string) (*MpdLogEvents, error) {
+// reads until ctx is done
+func NewMpdLogReader(ctx context.Context, logFile string) (*MpdLogEvents, error) {
 	logrus.Infof("Create MPD log pipe: %s", logFile)
 
 	// os.Remove(logFile)
@@ -40,19 +49,56 @@ func NewMpdLogReader(logFile string) (*MpdLogEvents, error) {
 		return nil, err
 	}
 
-	e := &MpdLogEvents{
-		AddEvent:    make(chan string),
-		DeleteEvent: make(chan string),
+	e := newMpdLogEvents()
+
+	// unblock a read waiting on the pipe
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go e.run(ctx, bufio.NewReader(f))
+	return e, nil
+}
+
+// process to tail a regular log file written by MPD
+// offset of the last processed line is kept in offsetFile to resume after restart
+func NewMpdLogTailer(ctx context.Context, logFile, offsetFile string) (*MpdLogEvents, error) {
+	logrus.Infof("Tail MPD log file: %s", logFile)
+
+	t := &logTailer{
+		path:       logFile,
+		offsetFile: offsetFile,
 	}
 
-	go e.run(bufio.NewReader(f))
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	e := newMpdLogEvents()
+
+	go e.runTail(ctx, t)
 	return e, nil
 }
 
+func newMpdLogEvents() *MpdLogEvents {
+	return &MpdLogEvents{
+		AddEvent:    make(chan string),
+		DeleteEvent: make(chan string),
+		Done:        make(chan struct{}),
+	}
+}
+
 // parse logs and send items to add and remove channels
-func (e *MpdLogEvents) run(reader *bufio.Reader) {
+func (e *MpdLogEvents) run(ctx context.Context, reader *bufio.Reader) {
+	defer close(e.Done)
+
 	for {
 		line, err := reader.ReadString('\n')
+		if ctx.Err() != nil {
+			logrus.Infof("Stop reading MPD log")
+			return
+		}
 		logrus.Infof("%s", line)
 
 		if err != nil {
@@ -60,13 +106,287 @@ func (e *MpdLogEvents) run(reader *bufio.Reader) {
 			time.Sleep(1000 * time.Millisecond)
 		}
 
-		if strings.Contains(line, logAddedString) {
-			str := strings.Split(line, logAddedString)
-			e.AddEvent <- strings.TrimSuffix(str[len(str)-1], "\n")
+		e.handleLine(line)
+	}
+}
+
+// read complete lines from the tailed file and follow truncation and rotation
+// offset is saved on stop
+// the offset covers lines handed to the indexer, not lines indexed, so updates still
+// queued for the search backend when the process dies are lost until the next reconcile
+func (e *MpdLogEvents) runTail(ctx context.Context, t *logTailer) {
+	defer close(e.Done)
+
+	var unsaved int
+
+	for {
+		if ctx.Err() != nil {
+			t.saveOffset()
+			logrus.Infof("Stop reading MPD log")
+			return
+		}
+
+		line, err := t.readLine()
+		if err == nil {
+			e.handleLine(line)
+
+			unsaved++
+			if unsaved >= logOffsetSaveLines {
+				t.saveOffset()
+				unsaved = 0
+			}
+			continue
+		}
+
+		if err != io.EOF {
+			logrus.Errorf("Error reading from log file: %v", err)
+		}
+
+		// old file read to the end after MPD moved on to the new one
+		// nothing more is written to it so a last line without a newline is complete
+		if t.rotated {
+			if line := t.flushPartial(); line != "" {
+				e.handleLine(line)
+				unsaved++
+			}
+			if err := t.openFile(t.path, 0); err != nil {
+				logrus.Errorf("Error following log file: %v", err)
+			} else {
+				continue
+			}
+		}
+
+		// caught up
+		if unsaved > 0 {
+			t.saveOffset()
+			unsaved = 0
+		}
+
+		select {
+		case <-time.After(logPollInterval):
+		case <-ctx.Done():
+			continue
+		}
+		if err := t.follow(); err != nil {
+			logrus.Errorf("Error following log file: %v", err)
+		}
+	}
+}
+
+func (e *MpdLogEvents) handleLine(line string) {
+	event, ok := mpd.ParseLogLine(line, time.Now())
+	if !ok {
+		return
+	}
+
+	switch event.Action {
+	case mpd.LogActionAdded:
+		e.AddEvent <- event.Path
+
+	case mpd.LogActionRemoved:
+		e.DeleteEvent <- event.Path
+	}
+}
+
+//
+// log file tailer
+//
 
-		} else if strings.Contains(line, logDeletedString) {
-			str := strings.Split(line, logDeletedString)
-			e.DeleteEvent <- strings.TrimSuffix(str[len(str)-1], "\n")
+// position saved to offset file
+type logPosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type logTailer struct {
+	path       string
+	offsetFile string
+
+	file   *os.File
+	reader *bufio.Reader
+	inode  uint64
+	// offset of the end of the last complete line read
+	offset int64
+	// incomplete line at end of file
+	partial string
+	// path is a new file so switch to it once the open one is read to the end
+	rotated bool
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// open log file and seek to saved offset
+// with no saved offset start at end of file and leave existing lines to the reconciler
+func (t *logTailer) open() error {
+	saved, ok := t.loadOffset()
+
+	// log was rotated while stopped - finish the rotated file first
+	if ok {
+		if info, err := os.Stat(t.path); err == nil && fileInode(info) != saved.Inode {
+			if info, err := os.Stat(t.path + ".1"); err == nil && fileInode(info) == saved.Inode {
+				if err := t.openFile(t.path+".1", saved.Offset); err == nil {
+					logrus.Infof("Resume rotated MPD log file: %s", t.path+".1")
+					return nil
+				}
+			}
+			saved = logPosition{}
 		}
 	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	offset := info.Size()
+	switch {
+	case ok && saved.Inode == fileInode(info) && saved.Offset <= info.Size():
+		offset = saved.Offset
+	case ok:
+		offset = 0
+	}
+
+	return t.openFile(t.path, offset)
+}
+
+func (t *logTailer) openFile(path string, offset int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	if t.file != nil {
+		t.file.Close()
+	}
+
+	t.file = f
+	t.reader = bufio.NewReader(f)
+	t.inode = fileInode(info)
+	t.offset = offset
+	t.partial = ""
+	t.rotated = false
+
+	logrus.Infof("Open MPD log file: %s at offset %d", path, offset)
+	return nil
+}
+
+// return next complete line
+// incomplete lines at end of file are held until the rest is written
+func (t *logTailer) readLine() (string, error) {
+	line, err := t.reader.ReadString('\n')
+	if err != nil {
+		t.partial += line
+		return "", err
+	}
+
+	line = t.partial + line
+	t.partial = ""
+	t.offset += int64(len(line))
+
+	return line, nil
+}
+
+// take incomplete line at end of file as read
+func (t *logTailer) flushPartial() string {
+	line := t.partial
+	t.partial = ""
+	t.offset += int64(len(line))
+
+	return line
+}
+
+// check for truncation or rotation after reaching end of file
+func (t *logTailer) follow() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		// rotated and new file not created yet
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// rotated - MPD keeps writing to the old file until it reopens the log
+	// wait for the new file to be written to then read the old one to the end again before switching
+	if fileInode(info) != t.inode {
+		if info.Size() > 0 && !t.rotated {
+			logrus.Infof("MPD log file rotated: %s", t.path)
+			t.rotated = true
+		}
+		return nil
+	}
+
+	// truncated in place
+	if info.Size() < t.offset+int64(len(t.partial)) {
+		logrus.Infof("MPD log file truncated: %s", t.path)
+		return t.openFile(t.path, 0)
+	}
+
+	return nil
+}
+
+func (t *logTailer) loadOffset() (logPosition, bool) {
+	var o logPosition
+
+	if t.offsetFile == "" {
+		return o, false
+	}
+
+	b, err := ioutil.ReadFile(t.offsetFile)
+	if err != nil {
+		return o, false
+	}
+
+	if err := json.Unmarshal(b, &o); err != nil {
+		logrus.Errorf("Error reading log offset file: %v", err)
+		return o, false
+	}
+
+	return o, true
+}
+
+// write offset to temp file and rename to avoid leaving a partial offset file
+func (t *logTailer) saveOffset() {
+	if t.offsetFile == "" {
+		return
+	}
+
+	b, err := json.Marshal(logPosition{
+		Inode:  t.inode,
+		Offset: t.offset,
+	})
+	if err != nil {
+		return
+	}
+
+	tmp := t.offsetFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		logrus.Errorf("Error writing log offset file: %v", err)
+		return
+	}
+
+	if err := os.Rename(tmp, t.offsetFile); err != nil {
+		logrus.Errorf("Error writing log offset file: %v", err)
+	}
 }
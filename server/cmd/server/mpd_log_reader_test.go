@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTailRotateMidLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpdlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tailer := &logTailer{path: path}
+	if err := tailer.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// last line of the old file is never finished
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("Jan 05 10:11 : update: added a.mp3\nJan 05 10:11 : update: added b.mp3")
+	f.Close()
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("Jan 05 10:12 : update: added c.mp3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := newMpdLogEvents()
+	go e.runTail(ctx, tailer)
+
+	var added []string
+	for len(added) < 3 {
+		select {
+		case file := <-e.AddEvent:
+			added = append(added, file)
+		case <-time.After(5 * logPollInterval):
+			t.Fatalf("added %v, timed out waiting for more", added)
+		}
+	}
+
+	if want := []string{"a.mp3", "b.mp3", "c.mp3"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added %v, want %v", added, want)
+	}
+
+	cancel()
+	<-e.Done
+}
@@ -1,83 +1,151 @@
+//
+// track playlist version and length to report playlist changes to clients
+//
+
 package server
 
 import (
 	"strconv"
-	// "fmt"
+
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+	"github.com/sirupsen/logrus"
 )
 
 type PlaylistStatus struct {
 	version int
 	length  int
-	// playlist last updated index
-	lastChangePosStart int
-	lastChangePosEnd   int
 }
 
+// call update once MPD is connected
 func NewPlaylistStatus() *PlaylistStatus {
-	p := &PlaylistStatus{}
-	// p.update()
-
-	// attrs, _ := mpdClient.Conn.PlaylistInfo(p.lastChangePosStart, p.lastChangePosEnd)
-	// fmt.Printf("playlist: %v", attrs)
-
-	return p
+	return &PlaylistStatus{}
 }
 
-func (p *PlaylistStatus) update() {
-	attrs, err := mpdClient.Conn.Status()
+// update playlist version and length from MPD status
+func (p *PlaylistStatus) update() error {
+	var attrs mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		attrs, err = conn.Status()
+		return err
+	})
 	if err != nil {
-		return
+		return err
 	}
 
 	version, err := strconv.Atoi(attrs["playlist"])
-	if err == nil {
-		if p.version < version {
-			// Update change positions if version updated
-			p.updatePlaylistChangePos()
-			p.version = version
-		}
+	if err != nil {
+		return err
 	}
 
 	length, err := strconv.Atoi(attrs["playlistlength"])
 	if err != nil {
-		p.length = length
+		return err
 	}
+
+	p.version = version
+	p.length = length
+	return nil
 }
 
-func (p *PlaylistStatus) updatePlaylistChangePos() {
-	attrs, err := mpdClient.PlChangePosId(p.version, -1, -1)
+// when playlist changes, get the start and end index of change
+func (p *PlaylistStatus) getChangePos(version int) (int, int, error) {
+	attrs, err := mpdClient.PlChangePosId(version, -1, -1)
 	if err != nil {
-		return
+		return 0, 0, err
 	}
 
+	var (
+		startPos = 0
+		endPos   = 0
+	)
+
 	if len(attrs) > 0 {
 		v, ok := attrs[0]["cpos"]
 		if ok {
 			i, err := strconv.Atoi(v)
-			if err == nil {
-				p.lastChangePosStart = i
+			if err != nil {
+				return 0, 0, err
 			}
+			startPos = i
 		}
 
 		v, ok = attrs[len(attrs)-1]["cpos"]
 		if ok {
 			i, err := strconv.Atoi(v)
-			if err == nil {
-				p.lastChangePosEnd = i
+			if err != nil {
+				return 0, 0, err
 			}
+			endPos = i
 		}
+
+		return startPos, endPos, nil
 	}
+
+	// if no result, last N items were removed
+	return -1, -1, nil
 }
 
-// keep playlist in memory so that changes can be better reported
-// func (p *PlaylistStatus) syncPlaylist(batchSize int) {
+// update status and create add, delete or move message for the change
+func (p *PlaylistStatus) createChangedMessage() (*socketMessage, error) {
+	prevVersion := p.version
+	prevLength := p.length
 
-// 	start := p.lastChangePosStart
-// 	end := start + batchSize
+	if err := p.update(); err != nil {
+		return nil, err
+	}
 
-// 	for end < p.lastChangePosEnd {
-// 		attrs, err := mpdClient.Conn.PlaylistInfo(start, end)
+	logrus.Infof("Playlist update length: %v -> %v", prevLength, p.length)
+	logrus.Infof("Playlist update version: %v -> %v", prevVersion, p.version)
 
-// 		fmt.Prinf("playlist: %v", attrs)
-// 	}
-// }
+	switch {
+	case p.length > prevLength:
+		// Behavior for add to playlist
+		// 0. song1
+		// 1. song2 <-- added
+		// 2. song3 <-- added
+		// 3. song4
+		// 4. song5
+		// Receives: start: 0, end: 3 (new length of playlist)
+		addCount := p.length - prevLength
+		changeStartPos, _, err := p.getChangePos(prevVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.Infof("Playlist add positions at: %v count: %v", changeStartPos, addCount)
+		return &socketMessage{Data: []int{changeStartPos, addCount}, Name: "playlistadd"}, nil
+
+	case p.length < prevLength:
+		// Behavior for removed from playlist
+		// 0. song1
+		// 1. song2 <-- deleting
+		// 2. song3 <-- deleting
+		// 3. song4
+		// 4. song5
+		// Receives: start: 1, end: 2 (new length of playlist)
+		removeCount := prevLength - p.length
+		changeStartPos, _, err := p.getChangePos(prevVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		// if negative last items were removed
+		if changeStartPos < 0 {
+			changeStartPos = p.length
+		}
+
+		logrus.Infof("Playlist delete at: %v count: %v", changeStartPos, removeCount)
+		return &socketMessage{Data: []int{changeStartPos, removeCount}, Name: "playlistdelete"}, nil
+
+	default:
+		// Fallback for generic playlist changes (move, shuffle, etc)
+		changeStartPos, changeEndPos, err := p.getChangePos(prevVersion)
+		if err != nil {
+			return nil, err
+		}
+		changeCount := changeEndPos - changeStartPos + 1
+
+		logrus.Infof("Playlist moved positions at: %v count: %v", changeStartPos, changeCount)
+		return &socketMessage{Data: []int{changeStartPos, changeCount}, Name: "playlistmove"}, nil
+	}
+}
@@ -0,0 +1,761 @@
+//
+// HTTP and websocket API
+//
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/randomcoww/go-mpd-es/pkg/mpd"
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+)
+
+// Client is a middleman between the websocket connection and the hub.
+type Client struct {
+	hub *Hub
+
+	// The websocket connection.
+	conn *websocket.Conn
+
+	// Buffered channel of outbound messages.
+	send chan *socketMessage
+
+	// Closed by the hub when the client is dropped.
+	done chan struct{}
+}
+
+const (
+	// Time allowed to write a message to the client.
+	writeWait = 10 * time.Second
+)
+
+type response struct {
+	Message string
+}
+
+type socketMessage struct {
+	Name string      `json:"mutation"`
+	Data interface{} `json:"value"`
+}
+
+// http and websocket API server
+func newServer(listenUrl string, hub *Hub) *http.Server {
+	allowedHeaders := handlers.AllowedHeaders([]string{"X-Requested-With"})
+	allowedOrigins := handlers.AllowedOrigins([]string{"*"})
+	allowedMethods := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
+
+	r := mux.NewRouter()
+
+	r.HandleFunc("/healthcheck", healthCheck).
+		Methods("GET")
+
+	r.HandleFunc("/health/live", liveness).
+		Methods("GET")
+
+	r.HandleFunc("/health/ready", readiness).
+		Methods("GET")
+
+	r.Handle("/metrics", promhttp.Handler()).
+		Methods("GET")
+
+	r.HandleFunc("/database/search", searchDatabase).
+		Queries("q", "{query}").
+		Queries("start", "{start}").
+		Queries("size", "{size}").
+		Methods("GET")
+
+	r.HandleFunc("/database/export", export).
+		Queries("q", "{query}").
+		Methods("GET")
+
+	r.HandleFunc("/database/suggest", suggest).
+		Queries("q", "{query}").
+		Methods("GET")
+
+	r.HandleFunc("/database/facets", facets).
+		Methods("GET")
+
+	r.HandleFunc("/database/reconcile", reconcile).
+		Methods("POST")
+
+	r.HandleFunc("/database/deadletters", deadLetters).
+		Methods("GET")
+
+	r.HandleFunc("/database/deadletters/replay", replayDeadLetters).
+		Methods("POST")
+
+	// websocket handler
+	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	})
+
+	return &http.Server{
+		Addr:    listenUrl,
+		Handler: handlers.CORS(allowedHeaders, allowedOrigins, allowedMethods)(r),
+	}
+}
+
+//
+// broadcast events
+//
+
+func createStatusMessage() (*socketMessage, error) {
+	var attrs mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		attrs, err = conn.Status()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &socketMessage{Data: attrs, Name: "status"}, nil
+}
+
+func createCurrentSongMessage() (*socketMessage, error) {
+	var attrs mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		attrs, err = conn.CurrentSong()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &socketMessage{Data: attrs, Name: "currentsong"}, nil
+}
+
+func createSeekMessage() (*socketMessage, error) {
+	var attrs mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		attrs, err = conn.Status()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch attrs["state"] {
+	case "play":
+		elapsed, err := strconv.ParseFloat(attrs["elapsed"], 32)
+		if err != nil {
+			return nil, err
+		}
+
+		duration, err := strconv.ParseFloat(attrs["duration"], 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return &socketMessage{Data: []float64{elapsed, duration}, Name: "seek"}, nil
+	}
+	return nil, nil
+}
+
+func createUpdateDatabaseMessage() *socketMessage {
+	return &socketMessage{Name: "updatedb"}
+}
+
+//
+// client specific events
+//
+
+func createPlaylistQueryMessage(start, end int) (*socketMessage, error) {
+	var attrs []mpd.Attrs
+	err := mpdClient.Run(func(conn *mpd.Conn) (err error) {
+		attrs, err = conn.PlaylistInfo(start, end)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &socketMessage{Data: attrs, Name: "playlistquery"}, nil
+}
+
+func createSearchMessage(text string, filters map[string][]string, cursor string, start, size int) (*socketMessage, error) {
+	q, err := query.Parse(text, esSongQueryFields)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := searchIndex.Search(q, filterFields(filters), cursor, start, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &socketMessage{Data: result, Name: "search"}, nil
+}
+
+type suggestion struct {
+	search.Suggestion
+	// display text e.g. artist: name
+	Text string `json:"text"`
+	// filter for search and facets to list results for the suggestion
+	Filter map[string][]string `json:"filter"`
+}
+
+func createSuggestMessage(text string, size int) (*socketMessage, error) {
+	if size <= 0 {
+		size = esSongSuggestSize
+	}
+
+	suggestions, err := searchIndex.Suggest(text, esSongSuggest, size)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]suggestion, len(suggestions))
+	for i, s := range suggestions {
+		result[i] = suggestion{
+			Suggestion: s,
+			Text:       s.Type + ": " + s.Value,
+			Filter:     map[string][]string{s.Type: []string{s.Value}},
+		}
+	}
+
+	return &socketMessage{Data: result, Name: "suggest"}, nil
+}
+
+func createFacetsMessage(text string, filters map[string][]string, size int) (*socketMessage, error) {
+	if size <= 0 {
+		size = esSongFacetSize
+	}
+
+	q, err := query.Parse(text, esSongQueryFields)
+	if err != nil {
+		return nil, err
+	}
+
+	facets, err := searchIndex.Facets(q, esSongFacets, filters, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &socketMessage{Data: facets, Name: "facets"}, nil
+}
+
+// query syntax error for the client to show
+// [request name, message, position]
+func createQueryErrorMessage(name string, err *query.ParseError) *socketMessage {
+	return &socketMessage{Data: []interface{}{name, err.Message, err.Pos}, Name: "queryerror"}
+}
+
+//
+// send broadcast events to each client
+//
+
+func (c *Client) writeSocketEvents() {
+	defer func() {
+		logrus.Infof("Server: Close writer")
+		c.conn.Close()
+		c.hub.writers.Done()
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			// The hub dropped the client.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteJSON(*msg); err != nil {
+				logrus.Errorf("Server: Error writing socket: %v", err)
+				return
+			}
+		}
+	}
+}
+
+//
+// read messages from client
+//
+
+// queue a message for this client only
+// dropped if the hub has dropped the client
+func (c *Client) reply(msg *socketMessage) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	}
+}
+
+func (c *Client) readSocketEvents() {
+	defer func() {
+		logrus.Infof("Server: Close reader")
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	for {
+		v := &socketMessage{}
+
+		err := c.conn.ReadJSON(v)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logrus.Errorf("Server: Error reading socket: %v", err)
+			}
+			return
+		}
+
+		if err := c.handleSocketMessage(v); err != nil {
+			logrus.Errorf("Server: Error handling %s: %v", v.Name, err)
+		}
+	}
+}
+
+// run command from socket message
+// data is decoded from JSON so numbers come as float64
+func (c *Client) handleSocketMessage(v *socketMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Server: Recovered bad message %s: %v", v.Name, r)
+		}
+	}()
+
+	switch v.Name {
+	case "seek":
+		t := int64(v.Data.(float64) * 1000000000)
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.SeekCur(time.Duration(t), false)
+		})
+
+		// client specific playlist query
+	case "playlistquery":
+		d := v.Data.([]interface{})
+		start := int(d[0].(float64))
+		end := int(d[1].(float64))
+
+		msg, err := createPlaylistQueryMessage(start, end)
+		if err != nil {
+			return err
+		}
+		c.reply(msg)
+
+		// client specific current song query
+	case "currentsong":
+		msg, err := createCurrentSongMessage()
+		if err != nil {
+			return err
+		}
+		c.reply(msg)
+
+		// global playlist items moved
+		// send only and allow server to emit event
+	case "playlistmove":
+		d := v.Data.([]interface{})
+		start := int(d[0].(float64))
+		end := int(d[1].(float64))
+		position := int(d[2].(float64))
+
+		if start != position {
+			err = mpdClient.Run(func(conn *mpd.Conn) error {
+				return conn.Move(start, end, position)
+			})
+		}
+
+	case "playid":
+		// -1 for play current
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.PlayID(int(v.Data.(float64)))
+		})
+
+	case "stop":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Stop()
+		})
+
+	case "pause":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Pause(true)
+		})
+
+	case "playnext":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Next()
+		})
+
+	case "playprev":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Previous()
+		})
+
+	case "removeid":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.DeleteID(int(v.Data.(float64)))
+		})
+
+		// file path from search results
+		// CUE tracks are virtual files in the MPD database so this queues only that track
+	case "addpath":
+		d := v.Data.([]interface{})
+		path := d[0].(string)
+		position := int(d[1].(float64))
+
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			_, err := conn.AddID(path, position)
+			return err
+		})
+
+		// client specific database search
+		// [query, start, size, {filter: [values]}, cursor]
+		// cursor from the previous page continues after its last hit
+	case "search":
+		d := v.Data.([]interface{})
+		text := d[0].(string)
+		start := int(d[1].(float64))
+		size := int(d[2].(float64))
+
+		filters := make(map[string][]string)
+		if len(d) > 3 {
+			filters = parseFilterData(d[3])
+		}
+
+		var cursor string
+		if len(d) > 4 {
+			cursor = d[4].(string)
+		}
+
+		msg, err := createSearchMessage(text, filters, cursor, start, size)
+		if err, ok := err.(*query.ParseError); ok {
+			c.reply(createQueryErrorMessage(v.Name, err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.reply(msg)
+
+		// add every search result to the queue in result order
+		// [query, {filter: [values]}]
+	case "addsearch":
+		d := v.Data.([]interface{})
+		text := d[0].(string)
+
+		filters := make(map[string][]string)
+		if len(d) > 1 {
+			filters = parseFilterData(d[1])
+		}
+
+		q, err := query.Parse(text, esSongQueryFields)
+		if err, ok := err.(*query.ParseError); ok {
+			c.reply(createQueryErrorMessage(v.Name, err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return searchIndex.Export(q, filterFields(filters), func(hit search.Hit) error {
+			return mpdClient.Run(func(conn *mpd.Conn) error {
+				return conn.Add(hit.Id)
+			})
+		})
+
+		// client specific facet counts
+		// [query, {facet: [values]}, size]
+	case "facets":
+		d := v.Data.([]interface{})
+		text := d[0].(string)
+		size := int(d[2].(float64))
+
+		msg, err := createFacetsMessage(text, parseFilterData(d[1]), size)
+		if err, ok := err.(*query.ParseError); ok {
+			c.reply(createQueryErrorMessage(v.Name, err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.reply(msg)
+
+		// client specific search as you type suggestions
+		// [text, size]
+	case "suggest":
+		d := v.Data.([]interface{})
+		text := d[0].(string)
+		size := int(d[1].(float64))
+
+		msg, err := createSuggestMessage(text, size)
+		if err != nil {
+			return err
+		}
+		c.reply(msg)
+
+	case "clear":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			return conn.Clear()
+		})
+
+	case "updatedb":
+		err = mpdClient.Run(func(conn *mpd.Conn) error {
+			_, err := conn.Update("")
+			return err
+		})
+
+	case "reconcile":
+		reconciler.Trigger()
+	}
+	return err
+}
+
+//
+// web socket feeder
+// based on example https://github.com/gorilla/websocket/blob/master/examples/filewatch/main.go
+//
+
+func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.Errorf("Server: Websocket upgrade failed: %v", err)
+		return
+	}
+
+	if !hub.addWriter() {
+		ws.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		ws.Close()
+		return
+	}
+
+	client := &Client{
+		hub:  hub,
+		conn: ws,
+		send: make(chan *socketMessage, 256),
+		done: make(chan struct{}),
+	}
+
+	client.hub.register <- client
+	go client.writeSocketEvents()
+	go client.readSocketEvents()
+}
+
+//
+// http handle funcs
+//
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response{"ok"})
+}
+
+func searchDatabase(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	logrus.Infof("Server: Search database %v", params)
+
+	msg, err := createSearchMessage(
+		params["query"],
+		parseFilterParams(r, esSongFilters),
+		r.URL.Query().Get("cursor"),
+		parseNum(params["start"]),
+		parseNum(params["size"]))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := err.(*query.ParseError); ok || err == search.ErrInvalidCursor {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(msg.Data)
+}
+
+// every search result as one JSON line per song
+func export(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	logrus.Infof("Server: Export database %v", params)
+
+	q, err := query.Parse(params["query"], esSongQueryFields)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err = searchIndex.Export(q, filterFields(parseFilterParams(r, esSongFilters)), func(hit search.Hit) error {
+		return enc.Encode(hit.Song)
+	})
+	// status is already sent
+	if err != nil {
+		logrus.Errorf("Server: Export database: %v", err)
+	}
+}
+
+func suggest(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	size := esSongSuggestSize
+	if params.Get("size") != "" {
+		size = parseNum(params.Get("size"))
+	}
+
+	msg, err := createSuggestMessage(params.Get("q"), size)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(msg.Data)
+}
+
+// facet counts narrowed by q and chosen values passed as facet name parameters
+// e.g. /database/facets?q=jazz&genre=Jazz&decade=1950
+func facets(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	size := esSongFacetSize
+	if params.Get("size") != "" {
+		size = parseNum(params.Get("size"))
+	}
+
+	msg, err := createFacetsMessage(params.Get("q"), parseFilterParams(r, esSongFacets), size)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := err.(*query.ParseError); ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(msg.Data)
+}
+
+func reconcile(w http.ResponseWriter, r *http.Request) {
+	reconciler.Trigger()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response{"reconcile started"})
+}
+
+func deadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	replayer, ok := searchIndex.(search.Replayer)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response{"search backend has no dead letters"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"pending": replayer.DeadLetters()})
+}
+
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	replayer, ok := searchIndex.(search.Replayer)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response{"search backend has no dead letters"})
+		return
+	}
+
+	n, err := replayer.ReplayDeadLetters()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"replayed": n})
+}
+
+//
+// helpers
+//
+
+// filter values from websocket message data
+// {name: [values]}
+func parseFilterData(data interface{}) map[string][]string {
+	filters := make(map[string][]string)
+
+	for name, values := range data.(map[string]interface{}) {
+		for _, value := range values.([]interface{}) {
+			filters[name] = append(filters[name], fmt.Sprint(value))
+		}
+	}
+	return filters
+}
+
+// filter values from query parameters named after the allowed filters
+func parseFilterParams(r *http.Request, allowed map[string]string) map[string][]string {
+	params := r.URL.Query()
+	filters := make(map[string][]string)
+
+	for name := range allowed {
+		if values, ok := params[name]; ok {
+			filters[name] = values
+		}
+	}
+	return filters
+}
+
+// key filters by index field
+func filterFields(filters map[string][]string) map[string][]string {
+	fields := make(map[string][]string)
+
+	for name, values := range filters {
+		if field, ok := esSongFilters[name]; ok {
+			fields[field] = values
+		}
+	}
+	return fields
+}
+
+func parseNum(input string) int {
+	v, err := strconv.Atoi(input)
+	if err != nil {
+		logrus.Errorf("Server: Error parsing param %s: %v", input, err)
+		v = -1
+	}
+
+	return v
+}
@@ -0,0 +1,463 @@
+//
+// bulk processor shared by the log indexer, reconciler and index rebuilds
+// flushes by action count, size and interval, retries rejected items and
+// blocks callers while too many actions are waiting
+//
+
+package elasticsearch
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/randomcoww/go-mpd-es/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+const (
+	// flush once this many actions or bytes are waiting or after interval
+	bulkActions  = 1000
+	bulkBytes    = 5 << 20
+	bulkInterval = 2 * time.Second
+
+	// callers block while this many actions are waiting
+	bulkMaxPending = 10 * bulkActions
+
+	// attempts for items ES rejects as overloaded before giving up on them
+	bulkRetries = 5
+
+	bulkBackoffMin = 1 * time.Second
+	bulkBackoffMax = 1 * time.Minute
+)
+
+type BulkAction struct {
+	// index or delete
+	Op    string      `json:"op"`
+	Index string      `json:"index"`
+	Id    string      `json:"id"`
+	Doc   interface{} `json:"doc,omitempty"`
+}
+
+// action ES did not apply
+type BulkFailure struct {
+	BulkAction
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type bulkItem struct {
+	BulkAction
+	request  elastic.BulkableRequest
+	size     int
+	attempts int
+	// failed requests while first in a batch
+	requestAttempts int
+	// last failure for reporting once out of attempts
+	status int
+	reason string
+}
+
+type bulkProcessor struct {
+	c *EsClient
+
+	lock  sync.Mutex
+	space *sync.Cond
+	queue []*bulkItem
+	bytes int
+	// set by failPending so later actions are failed instead of queued
+	closed bool
+
+	// one request at a time keeps actions in order
+	sendLock sync.Mutex
+	flush    chan struct{}
+	backoff  time.Duration
+
+	// called with each action given up on
+	onFailure func(BulkFailure)
+}
+
+func newBulkProcessor(c *EsClient) *bulkProcessor {
+	p := &bulkProcessor{
+		c:     c,
+		flush: make(chan struct{}, 1),
+	}
+	p.space = sync.NewCond(&p.lock)
+
+	return p
+}
+
+// queue action waiting while the queue is full
+func (p *bulkProcessor) add(a BulkAction) {
+	item := &bulkItem{BulkAction: a}
+
+	switch a.Op {
+	case "delete":
+		item.request = elastic.NewBulkDeleteRequest().
+			Index(a.Index).
+			Type(p.c.indexType).
+			Id(a.Id)
+	default:
+		item.request = elastic.NewBulkIndexRequest().
+			Index(a.Index).
+			Type(p.c.indexType).
+			Id(a.Id).
+			Doc(a.Doc)
+	}
+
+	lines, err := item.request.Source()
+	if err != nil {
+		p.fail(item, 0, err.Error())
+		return
+	}
+	for _, l := range lines {
+		item.size += len(l) + 1
+	}
+
+	p.lock.Lock()
+	for len(p.queue) >= bulkMaxPending && !p.closed {
+		p.space.Wait()
+	}
+	// nothing is sent after failPending
+	if p.closed {
+		p.lock.Unlock()
+		p.fail(item, 0, "shutdown")
+		return
+	}
+	p.queue = append(p.queue, item)
+	p.bytes += item.size
+	full := len(p.queue) >= bulkActions || p.bytes >= bulkBytes
+	p.lock.Unlock()
+
+	if full {
+		select {
+		case p.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// actions waiting to be sent
+func (p *bulkProcessor) pending() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.queue)
+}
+
+// send when full or on interval once ES is ready
+// back off after failed requests
+// returns once the client context is done
+func (p *bulkProcessor) run() {
+	tick := time.NewTicker(bulkInterval)
+
+	for {
+		select {
+		case <-p.flush:
+		case <-tick.C:
+		case <-p.c.ctx.Done():
+			return
+		}
+
+		if p.pending() == 0 {
+			continue
+		}
+
+		if !p.c.waitIndex() {
+			return
+		}
+
+		if retry, err := p.flushAll(p.c.ctx); err != nil || retry {
+			p.sleep()
+			continue
+		}
+		p.backoff = 0
+	}
+}
+
+// send everything queued including retries until ctx is done
+// failed requests are retried with backoff as ES may come back before then
+// returns the last request error if ctx is done first
+func (p *bulkProcessor) flushWait(ctx context.Context) error {
+	backoff := bulkBackoffMin
+
+	for {
+		retry, err := p.flushAll(ctx)
+		if err == nil && !retry {
+			return nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > bulkBackoffMax {
+			backoff = bulkBackoffMax
+		}
+	}
+}
+
+// fail everything still queued and anything added after
+func (p *bulkProcessor) failPending(reason string) int {
+	p.lock.Lock()
+	items := p.queue
+	p.queue = nil
+	p.bytes = 0
+	p.closed = true
+	p.space.Broadcast()
+	p.lock.Unlock()
+
+	for _, item := range items {
+		p.fail(item, 0, reason)
+	}
+	return len(items)
+}
+
+func (p *bulkProcessor) sleep() {
+	switch {
+	case p.backoff == 0:
+		p.backoff = bulkBackoffMin
+	case p.backoff < bulkBackoffMax:
+		p.backoff *= 2
+		if p.backoff > bulkBackoffMax {
+			p.backoff = bulkBackoffMax
+		}
+	}
+
+	logrus.Infof("EsClient: Bulk update: Retry in %v", p.backoff)
+	time.Sleep(p.backoff)
+}
+
+// send everything queued
+// stops at the first failed request or retry leaving the rest queued
+func (p *bulkProcessor) flushAll(ctx context.Context) (bool, error) {
+	for {
+		retry, err := p.send(ctx)
+		if err != nil || retry {
+			return retry, err
+		}
+		if p.pending() == 0 {
+			return false, nil
+		}
+	}
+}
+
+// send one batch from the front of the queue
+// returns true if items were put back for a retry
+func (p *bulkProcessor) send(ctx context.Context) (bool, error) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	batch := p.take()
+	if len(batch) == 0 {
+		return false, nil
+	}
+
+	keep, retry, err := p.sendBatch(ctx, batch)
+	p.requeue(keep)
+	return retry, err
+}
+
+// send batch in one request
+// returns items to put back at the front of the queue
+func (p *bulkProcessor) sendBatch(ctx context.Context, batch []*bulkItem) ([]*bulkItem, bool, error) {
+	bulk := p.c.client().Bulk()
+	for _, item := range batch {
+		bulk.Add(item.request)
+	}
+
+	start := time.Now()
+	res, err := bulk.Do(ctx)
+
+	metrics.BulkBatchSize.Observe(float64(len(batch)))
+	metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		metrics.BulkFailures.WithLabelValues("request").Inc()
+		logrus.Errorf("EsClient: Bulk update: Failed: %v", err)
+		return p.rejected(ctx, batch, err)
+	}
+
+	var retry []*bulkItem
+	failed := 0
+
+	for i, result := range res.Items {
+		if i >= len(batch) {
+			break
+		}
+		item := batch[i]
+
+		for _, r := range result {
+			if r.Status >= 200 && r.Status < 300 {
+				continue
+			}
+			// deleting something already gone is fine
+			if item.Op == "delete" && r.Status == 404 {
+				continue
+			}
+
+			reason := ""
+			if r.Error != nil {
+				reason = r.Error.Type + ": " + r.Error.Reason
+			}
+
+			switch {
+			// a later action for the same document was applied
+			case superseded(batch[i+1:], item):
+			case r.Status == 429 || r.Status == 503:
+				retry = append(retry, item)
+				item.status, item.reason = r.Status, reason
+			default:
+				failed++
+				p.fail(item, r.Status, reason)
+			}
+		}
+	}
+
+	logrus.Infof("EsClient: Bulk update: Done: %d actions in %v, failed %d, retry %d",
+		len(batch), time.Since(start), failed, len(retry))
+
+	if len(retry) > 0 {
+		metrics.BulkFailures.WithLabelValues("retry").Add(float64(len(retry)))
+		return p.retryItems(retry), true, nil
+	}
+	return nil, false, nil
+}
+
+// handle a request that failed as a whole
+// retried as is while ES is unreachable or overloaded
+// other errors are retried up to bulkRetries times then the batch is split
+// until the actions ES won't take are found and failed on their own
+func (p *bulkProcessor) rejected(ctx context.Context, batch []*bulkItem, err error) ([]*bulkItem, bool, error) {
+	status := 0
+	if e, ok := err.(*elastic.Error); ok {
+		status = e.Status
+	}
+
+	if status == 0 || status == 429 || status == 503 {
+		return batch, true, err
+	}
+
+	batch[0].requestAttempts++
+	if batch[0].requestAttempts < bulkRetries {
+		return batch, true, err
+	}
+
+	if len(batch) == 1 {
+		p.fail(batch[0], status, err.Error())
+		return nil, false, nil
+	}
+
+	logrus.Errorf("EsClient: Bulk update: Split %d actions", len(batch))
+
+	half := len(batch) / 2
+	first, second := batch[:half], batch[half:]
+	for _, items := range [][]*bulkItem{first, second} {
+		items[0].requestAttempts = bulkRetries - 1
+	}
+
+	keep, retry, err := p.sendBatch(ctx, first)
+	if retry || err != nil {
+		return append(keep, second...), retry, err
+	}
+	return p.sendBatch(ctx, second)
+}
+
+// batch up to the count and size limits from the front of the queue
+func (p *bulkProcessor) take() []*bulkItem {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, size := 0, 0
+	for n < len(p.queue) && n < bulkActions {
+		if n > 0 && size+p.queue[n].size > bulkBytes {
+			break
+		}
+		size += p.queue[n].size
+		n++
+	}
+
+	batch := make([]*bulkItem, n)
+	copy(batch, p.queue[:n])
+	p.queue = p.queue[n:]
+	p.bytes -= size
+
+	p.space.Broadcast()
+	return batch
+}
+
+// items to put back for another attempt
+// items out of attempts are failed
+func (p *bulkProcessor) retryItems(items []*bulkItem) []*bulkItem {
+	var keep []*bulkItem
+	for _, item := range items {
+		item.attempts++
+		if item.attempts >= bulkRetries {
+			p.fail(item, item.status, item.reason)
+			continue
+		}
+		keep = append(keep, item)
+	}
+	return keep
+}
+
+// put items back at the front of the queue to keep them ahead of later actions
+// items from a request still in flight at failPending are failed
+func (p *bulkProcessor) requeue(keep []*bulkItem) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+
+		for _, item := range keep {
+			p.fail(item, 0, "shutdown")
+		}
+		return
+	}
+	defer p.lock.Unlock()
+
+	for _, item := range keep {
+		p.bytes += item.size
+	}
+	p.queue = append(keep, p.queue...)
+}
+
+func (p *bulkProcessor) setFailureHandler(fn func(BulkFailure)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.onFailure = fn
+}
+
+func (p *bulkProcessor) fail(item *bulkItem, status int, reason string) {
+	metrics.BulkFailures.WithLabelValues("item").Inc()
+	logrus.Errorf("EsClient: Bulk %s %s/%s: Failed: %d %s", item.Op, item.Index, item.Id, status, reason)
+
+	p.lock.Lock()
+	onFailure := p.onFailure
+	p.lock.Unlock()
+
+	if onFailure != nil {
+		onFailure(BulkFailure{
+			BulkAction: item.BulkAction,
+			Status:     status,
+			Reason:     reason,
+		})
+	}
+}
+
+// true if items has an action for the same document
+func superseded(items []*bulkItem, item *bulkItem) bool {
+	for _, i := range items {
+		if i.Index == item.Index && i.Id == item.Id {
+			return true
+		}
+	}
+	return false
+}
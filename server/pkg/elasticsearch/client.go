@@ -6,8 +6,13 @@ package elasticsearch
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"sync"
 	"time"
 
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
 	"github.com/randomcoww/go-mpd-es/pkg/util"
 	"github.com/sirupsen/logrus"
 	elastic "gopkg.in/olivere/elastic.v5"
@@ -17,35 +22,81 @@ var (
 	ctx = context.Background()
 )
 
+// time ES has to answer a ping before the connection is taken as down
+const pingTimeout = 10 * time.Second
+
+var _ search.Backend = (*EsClient)(nil)
+var _ search.Rebuilder = (*EsClient)(nil)
+var _ search.Replayer = (*EsClient)(nil)
+var _ search.Closer = (*EsClient)(nil)
+
 type EsClient struct {
-	eventHub *util.EventHub
+	ctx        context.Context
+	supervisor *util.Supervisor
 
 	url       string
 	index     string
 	indexType string
 	mapping   string
+	version   int
+
+	searchFields []string
+
+	connLock sync.RWMutex
+	conn     *elastic.Client
+	bulk     *bulkProcessor
 
-	conn *elastic.Client
-	bulk *elastic.BulkService
+	// rejected actions, nil if not kept
+	deadLetters *deadLetters
+
+	// closed once the index is first set up
+	indexReady chan struct{}
+
+	// physical index behind the index alias and new mapping version being built
+	indexLock sync.Mutex
+	current   string
+	pending   string
+	// index searched instead of the alias while it is being created
+	searching string
 }
 
 // new ES client
-func NewEsClient(url, index, indexType, mapping string) *EsClient {
+// index is an alias to a physical index per mapping version
+// connects and sets up the index in the background until ctx is done
+func NewEsClient(ctx context.Context, url, index, indexType, mapping string, version int) *EsClient {
 
 	logrus.Infof("EsClient: Start")
 
 	c := &EsClient{
-		eventHub: util.NewEventHub(),
+		ctx: ctx,
 
 		url:       url,
 		index:     index,
 		indexType: indexType,
 		mapping:   mapping,
+		version:   version,
+
+		indexReady: make(chan struct{}),
 	}
 
-	c.setReady()
-	go c.runRecovery()
-	go c.runIndexUpdate()
+	c.bulk = newBulkProcessor(c)
+
+	c.supervisor = util.NewSupervisor("EsClient", c.dial)
+	c.supervisor.Check = func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+
+		_, _, err := c.client().Ping(c.url).Do(ctx)
+		return err
+	}
+
+	go c.supervisor.Run(ctx)
+	go func() {
+		if c.waitIndex() {
+			close(c.indexReady)
+		}
+		c.bulk.run()
+	}()
 
 	return c
 }
@@ -54,181 +105,258 @@ func NewEsClient(url, index, indexType, mapping string) *EsClient {
 // get connection
 //
 
-func (c EsClient) pingTest() bool {
-	_, _, err := c.conn.Ping(c.url).Do(ctx)
-	return err == nil
-}
+func (c *EsClient) dial(ctx context.Context) error {
+	conn, err := elastic.NewSimpleClient(elastic.SetURL(c.url))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
 
-func (c *EsClient) waitConnect() {
-	for {
-		select {
-		case <-time.After(1000 * time.Millisecond):
-			conn, err := elastic.NewSimpleClient(elastic.SetURL(c.url))
+	if _, _, err := conn.Ping(c.url).Do(ctx); err != nil {
+		return err
+	}
+
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+	return nil
+}
 
-			if err == nil {
-				c.conn = conn
-				c.bulk = conn.Bulk()
+// send queued updates until ctx is done
+// updates still queued are failed and kept as dead letters if enabled
+func (c *EsClient) Close(ctx context.Context) error {
+	err := c.bulk.flushWait(ctx)
 
-				logrus.Infof("EsClient: Connection ready")
-				return
-			}
-		}
+	if n := c.bulk.failPending("shutdown"); n > 0 {
+		logrus.Errorf("EsClient: Close: %d updates not sent", n)
 	}
+	return err
 }
 
-func (c *EsClient) waitPingState(state bool) {
-	for {
-		select {
-		case <-time.After(1000 * time.Millisecond):
-			if c.pingTest() == state {
-				logrus.Infof("EsClient: Ping state changed: ", state)
-				return
-			}
-		}
-	}
+// current connection
+func (c *EsClient) client() *elastic.Client {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
+	return c.conn
 }
 
-func (c *EsClient) setReady() {
-	c.waitConnect()
-	c.waitPingState(true)
-	c.eventHub.Send <- "api_ready"
+// connection state for health checks
+func (c *EsClient) State() util.ConnStatus {
+	return c.supervisor.State()
 }
 
-func (c *EsClient) setDown() {
-	c.waitPingState(false)
-	c.eventHub.Send <- "api_down"
+// connection events dropped by topic for metrics
+func (c *EsClient) DroppedEvents() map[string]uint64 {
+	return c.supervisor.Events.Dropped()
 }
 
-func (c *EsClient) runRecovery() {
-	apiErrClient := c.eventHub.NewClient([]string{"api_down"})
-	apiReadyClient := c.eventHub.NewClient([]string{"api_ready"})
+//
+// Update index
+//
 
+// wait for connection and index
+// returns false if ctx is done first
+func (c *EsClient) waitIndex() bool {
 	for {
-		select {
-		case <-apiErrClient.Events:
-			c.setReady()
-			apiErrClient.Drain()
-
-		case <-apiReadyClient.Events:
-			c.setDown()
-			apiReadyClient.Drain()
+		if c.supervisor.WaitReady(c.ctx) != nil {
+			return false
+		}
+
+		err := c.ensureIndex()
+		if err == nil {
+			return true
 		}
+
+		c.supervisor.Down(err)
 	}
 }
 
-//
-// Update index
-//
-
-func (c *EsClient) getOrCreateIndex() error {
-	exists, err := c.conn.IndexExists(c.index).Do(ctx)
-	if err != nil {
-		return err
+// add index to next bulk update
+// blocks while too many updates are waiting
+func (c *EsClient) IndexBulk(id string, s interface{}) {
+	for _, index := range c.writeIndices() {
+		c.bulk.add(BulkAction{Op: "index", Index: index, Id: id, Doc: s})
 	}
+}
 
-	if exists {
-		logrus.Info("EsClient: Index exists: %s", c.index)
-		return nil
+// add deletion to next bulk update
+func (c *EsClient) DeleteBluk(id string) {
+	for _, index := range c.writeIndices() {
+		c.bulk.add(BulkAction{Op: "delete", Index: index, Id: id})
 	}
+}
 
-	_, err = c.conn.CreateIndex(c.index).BodyString(c.mapping).Do(ctx)
-	if err != nil {
+// updates waiting to be sent
+func (c *EsClient) BulkPending() int {
+	return c.bulk.pending()
+}
+
+// call fn with the id of every document in the index
+func (c *EsClient) ScrollIds(fn func(id string)) error {
+	if err := c.ensureIndex(); err != nil {
 		return err
 	}
 
-	logrus.Info("EsClient: Index created: %s", c.index)
-	return nil
-}
+	scroll := c.client().Scroll(c.searchIndex()).
+		Type(c.indexType).
+		FetchSource(false).
+		Size(1000)
+	defer scroll.Clear(ctx)
 
-func (c *EsClient) waitIndex() {
-	apiReadyClient := c.eventHub.NewClient([]string{"api_ready"})
 	for {
-		if err := c.getOrCreateIndex(); err == nil {
-			return
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 
-		c.eventHub.Send <- "api_down"
-		apiReadyClient.WaitEvent("api_ready")
+		for _, hit := range result.Hits.Hits {
+			fn(hit.Id)
+		}
 	}
 }
 
-// run bulk processing job
-func (c *EsClient) runIndexUpdate() {
-	updateClient := c.eventHub.NewClient([]string{"index_update"})
+//
+// Search
+//
 
-	for {
-		select {
-		case <-updateClient.Events:
-			c.waitIndex()
-			updateClient.Drain()
-
-			// Ok to try updating
-			_, err := c.bulk.Do(ctx)
-			if err != nil {
-				logrus.Errorf("EsClient: Bulk update: Failed: %v", err)
-			} else {
-				logrus.Info("EsClient: Bulk update: Success")
-			}
-		// Add some throtting for bulk update
-		case <-time.After(2000 * time.Millisecond):
-		}
+// indexed document or nil if not found
+func (c *EsClient) Get(id string) (*json.RawMessage, error) {
+	get, err := c.client().Get().
+		Index(c.searchIndex()).
+		Type(c.indexType).
+		Id(id).
+		Do(ctx)
+
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	return get.Source, nil
 }
 
-// Add index to next bulk update
-func (c *EsClient) IndexBulk(id string, s interface{}) {
-	c.bulk.Add(elastic.NewBulkIndexRequest().
-		Index(c.index).
-		Type(c.indexType).
-		Id(id).
-		Doc(s))
+// text fields searched by free text queries
+// fields need exact and cjk sub fields in the mapping
+func (c *EsClient) SetSearchFields(fields ...string) {
+	c.searchFields = fields
+}
 
-	c.eventHub.Send <- "index_update"
+func subFields(fields []string, sub string) []string {
+	result := make([]string, len(fields))
+	for i, f := range fields {
+		result[i] = f + "." + sub
+	}
+	return result
 }
 
-// Add deletion to next bulk update
-func (c *EsClient) DeleteBluk(id string) {
-	c.bulk.Add(elastic.NewBulkDeleteRequest().
-		Index(c.index).
-		Type(c.indexType).
-		Id(id))
+// free text query tolerant of typos, accents and CJK text
+// exact phrases score highest followed by all words and then fuzzy matches
+func (c *EsClient) textQuery(text string) elastic.Query {
+	if text == "" {
+		return elastic.NewMatchAllQuery()
+	}
 
-	c.eventHub.Send <- "index_update"
+	return elastic.NewBoolQuery().
+		Should(
+			elastic.NewMultiMatchQuery(text, subFields(c.searchFields, "exact")...).
+				Type("phrase").
+				Boost(4),
+			elastic.NewMultiMatchQuery(text, c.searchFields...).
+				Operator("and").
+				Boost(2),
+			// AUTO allows one edit for 3-5 characters and two above that
+			elastic.NewMultiMatchQuery(text, c.searchFields...).
+				Operator("and").
+				Fuzziness("AUTO").
+				PrefixLength(1).
+				MaxExpansions(50),
+			elastic.NewMultiMatchQuery(text, subFields(c.searchFields, "cjk")...).
+				Operator("and"),
+		).
+		MinimumNumberShouldMatch(1)
 }
 
-//
-// Search
-//
+// query narrowed by terms filters keyed by field
+func (c *EsClient) filteredQuery(parsed *query.Query, filters map[string][]string) elastic.Query {
+	q := elastic.NewBoolQuery().
+		Must(c.parsedQuery(parsed))
 
-// search database - go through elasticsearch
-func (c *EsClient) Get(file string) (*elastic.GetResult, error) {
-	get, err := c.conn.Get().
-		Index(c.index).
-		Type(c.indexType).
-		Id(file).
-		Do(ctx)
+	for field, values := range filters {
+		if len(values) == 0 {
+			continue
+		}
 
-	if err != nil {
-		return nil, err
+		terms := make([]interface{}, len(values))
+		for i, v := range values {
+			terms[i] = v
+		}
+		q.Filter(elastic.NewTermsQuery(field, terms...))
 	}
 
-	return get, nil
+	return q
 }
 
-// search
-func (c *EsClient) Search(query string, start, size int) (*elastic.SearchResult, error) {
-	search, err := c.conn.Search().
-		Index(c.index).
+// search with scores and highlighted matches
+// pages continue from cursor if set and from start otherwise
+// start is only used to number results when paging by cursor
+func (c *EsClient) Search(q *query.Query, filters map[string][]string, cursor string, start, size int) (*search.Result, error) {
+	s := c.client().Search().
+		Index(c.searchIndex()).
 		Type(c.indexType).
-		Query(elastic.NewSimpleQueryStringQuery(query)).
-		Pretty(true).
-		From(start).
-		Size(size).
-		Do(ctx)
+		Query(c.filteredQuery(q, filters)).
+		Highlight(c.highlight()).
+		SortBy(searchSort()...).
+		Size(size)
+
+	// from and size fail past index.max_result_window but search_after does not
+	if cursor != "" {
+		after, err := search.DecodeCursor(cursor, len(searchSort()))
+		if err != nil {
+			return nil, err
+		}
+		s = s.SearchAfter(after...)
+	} else {
+		s = s.From(start)
+	}
 
+	result, err := s.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return search, err
+	return newSearchResult(result, start, size), nil
+}
+
+// call fn for every search result in order without highlights
+// used to act on all results at once such as adding them to the queue
+func (c *EsClient) Export(q *query.Query, filters map[string][]string, fn func(search.Hit) error) error {
+	scroll := c.client().Scroll(c.searchIndex()).
+		Type(c.indexType).
+		Query(c.filteredQuery(q, filters)).
+		SortBy(searchSort()...).
+		Size(1000)
+	defer scroll.Clear(ctx)
+
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, hit := range newSearchResult(result, 0, 0).Hits {
+			if err := fn(hit); err != nil {
+				return err
+			}
+		}
+	}
 }
@@ -0,0 +1,180 @@
+//
+// index and delete actions ES rejected kept in a file to replay later
+//
+
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type deadLetter struct {
+	BulkFailure
+	Time time.Time `json:"time"`
+}
+
+type deadLetters struct {
+	path string
+
+	lock  sync.Mutex
+	count int
+}
+
+// open dead letter file at path counting actions already in it
+func openDeadLetters(path string) (*deadLetters, error) {
+	d := &deadLetters{
+		path: path,
+	}
+
+	letters, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+	d.count = len(letters)
+
+	return d, nil
+}
+
+func (d *deadLetters) write(f BulkFailure) {
+	b, err := json.Marshal(deadLetter{BulkFailure: f, Time: time.Now()})
+	if err != nil {
+		logrus.Errorf("EsClient: Dead letter %s: Failed: %v", f.Id, err)
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		logrus.Errorf("EsClient: Dead letter %s: Failed: %v", f.Id, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "%s\n", b); err != nil {
+		logrus.Errorf("EsClient: Dead letter %s: Failed: %v", f.Id, err)
+		return
+	}
+	d.count++
+}
+
+func (d *deadLetters) pending() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.count
+}
+
+// remove and return all dead letters
+func (d *deadLetters) take() ([]deadLetter, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(d.path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	d.count = 0
+
+	return letters, nil
+}
+
+func (d *deadLetters) read() ([]deadLetter, error) {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var letters []deadLetter
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var l deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			logrus.Errorf("EsClient: Skip bad line %d in %s: %v", line, d.path, err)
+			continue
+		}
+		letters = append(letters, l)
+	}
+	return letters, scanner.Err()
+}
+
+// keep actions ES rejects in a file to replay with ReplayDeadLetters
+func (c *EsClient) SetDeadLetterFile(path string) error {
+	d, err := openDeadLetters(path)
+	if err != nil {
+		return err
+	}
+
+	c.deadLetters = d
+	c.bulk.setFailureHandler(d.write)
+
+	if n := d.pending(); n > 0 {
+		logrus.Infof("EsClient: %d dead letters in %s", n, path)
+	}
+	return nil
+}
+
+// actions waiting in the dead letter file
+func (c *EsClient) DeadLetters() int {
+	if c.deadLetters == nil {
+		return 0
+	}
+	return c.deadLetters.pending()
+}
+
+// queue dead letters again and remove them from the file
+// only the last action for each document is replayed and goes to the current indices
+// actions failing again are written back
+func (c *EsClient) ReplayDeadLetters() (int, error) {
+	if c.deadLetters == nil {
+		return 0, nil
+	}
+
+	letters, err := c.deadLetters.take()
+	if err != nil {
+		return 0, err
+	}
+
+	last := make(map[string]int)
+	for i, l := range letters {
+		last[l.Id] = i
+	}
+
+	n := 0
+	for i, l := range letters {
+		if last[l.Id] != i {
+			continue
+		}
+
+		switch l.Op {
+		case "delete":
+			c.DeleteBluk(l.Id)
+		default:
+			c.IndexBulk(l.Id, l.Doc)
+		}
+		n++
+	}
+
+	logrus.Infof("EsClient: Replay dead letters: %d", n)
+	return n, nil
+}
@@ -0,0 +1,93 @@
+package elasticsearch
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters")
+
+	d, err := openDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.write(BulkFailure{
+		BulkAction: BulkAction{Op: "index", Index: "songs_v1", Id: "a.flac", Doc: map[string]interface{}{"title": "A"}},
+		Status:     400,
+		Reason:     "mapper_parsing_exception: failed to parse",
+	})
+	d.write(BulkFailure{
+		BulkAction: BulkAction{Op: "delete", Index: "songs_v1", Id: "b.flac"},
+		Status:     429,
+		Reason:     "es_rejected_execution_exception: queue full",
+	})
+
+	// count survives reopening
+	d, err = openDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.pending(); n != 2 {
+		t.Fatalf("pending = %d, want 2", n)
+	}
+
+	letters, err := d.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("took %d, want 2", len(letters))
+	}
+	if l := letters[0]; l.Op != "index" || l.Id != "a.flac" || l.Status != 400 || l.Doc.(map[string]interface{})["title"] != "A" {
+		t.Errorf("letter 0 = %+v", l)
+	}
+	if l := letters[1]; l.Op != "delete" || l.Id != "b.flac" || l.Reason != "es_rejected_execution_exception: queue full" {
+		t.Errorf("letter 1 = %+v", l)
+	}
+	if l := letters[0]; l.Time.IsZero() {
+		t.Errorf("letter 0 has no time")
+	}
+
+	if n := d.pending(); n != 0 {
+		t.Errorf("pending after take = %d, want 0", n)
+	}
+	if letters, _ := d.read(); len(letters) != 0 {
+		t.Errorf("file has %d letters after take", len(letters))
+	}
+}
+
+func TestFailPendingClosesQueue(t *testing.T) {
+	p := newBulkProcessor(&EsClient{indexType: "song"})
+
+	failed := make(chan BulkFailure, bulkMaxPending+2)
+	p.setFailureHandler(func(f BulkFailure) {
+		failed <- f
+	})
+
+	for i := 0; i < bulkMaxPending; i++ {
+		p.add(BulkAction{Op: "delete", Index: "songs_v1", Id: "a.flac"})
+	}
+
+	// blocked on a full queue
+	added := make(chan struct{})
+	go func() {
+		p.add(BulkAction{Op: "delete", Index: "songs_v1", Id: "b.flac"})
+		close(added)
+	}()
+
+	if n := p.failPending("shutdown"); n != bulkMaxPending {
+		t.Fatalf("failPending = %d, want %d", n, bulkMaxPending)
+	}
+	<-added
+
+	p.add(BulkAction{Op: "delete", Index: "songs_v1", Id: "c.flac"})
+
+	if n := p.pending(); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+	if n := len(failed); n != bulkMaxPending+2 {
+		t.Errorf("failed = %d, want %d", n, bulkMaxPending+2)
+	}
+}
@@ -0,0 +1,59 @@
+//
+// facet counts for browsing
+//
+
+package elasticsearch
+
+import (
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// count documents per value of each facet
+// fields maps facet names to keyword or numeric fields
+// filters holds values already chosen per facet and narrows all counts
+func (c *EsClient) Facets(q *query.Query, fields map[string]string, filters map[string][]string, size int) (map[string][]search.FacetBucket, error) {
+	fieldFilters := make(map[string][]string)
+	for name, values := range filters {
+		if field, ok := fields[name]; ok {
+			fieldFilters[field] = values
+		}
+	}
+
+	s := c.client().Search().
+		Index(c.searchIndex()).
+		Type(c.indexType).
+		Query(c.filteredQuery(q, fieldFilters)).
+		Size(0)
+
+	for name, field := range fields {
+		s = s.Aggregation(name, elastic.NewTermsAggregation().
+			Field(field).
+			Size(size))
+	}
+
+	result, err := s.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	facets := make(map[string][]search.FacetBucket)
+	for name := range fields {
+		agg, ok := result.Aggregations.Terms(name)
+		if !ok {
+			continue
+		}
+
+		buckets := make([]search.FacetBucket, 0, len(agg.Buckets))
+		for _, b := range agg.Buckets {
+			buckets = append(buckets, search.FacetBucket{
+				Value: b.Key,
+				Count: b.DocCount,
+			})
+		}
+		facets[name] = buckets
+	}
+
+	return facets, nil
+}
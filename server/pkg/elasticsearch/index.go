@@ -0,0 +1,234 @@
+//
+// versioned indices behind an alias
+// searches go through the alias while a new mapping version is built in the background
+//
+
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// time to send queued updates before and after the alias is switched
+const swapFlushTimeout = 2 * time.Minute
+
+// physical index name for mapping version
+func (c *EsClient) versionIndex() string {
+	return fmt.Sprintf("%s_v%d", c.index, c.version)
+}
+
+// index the alias points to
+// returns the alias name itself for an index created before versioning and empty if neither exists
+func (c *EsClient) aliasIndex() (string, error) {
+	exists, err := c.client().IndexExists(c.index).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", nil
+	}
+
+	aliases, err := c.client().Aliases().Index(c.index).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	indices := aliases.IndicesByAlias(c.index)
+	if len(indices) == 0 {
+		return c.index, nil
+	}
+	return indices[0], nil
+}
+
+func (c *EsClient) createIndex(index string) error {
+	exists, err := c.client().IndexExists(index).Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		logrus.Infof("EsClient: Index exists: %s", index)
+		return nil
+	}
+
+	_, err = c.client().CreateIndex(index).BodyString(c.mapping).Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("EsClient: Index created: %s", index)
+	return nil
+}
+
+// create index for current mapping version
+// if the alias points to an older version the new index is left pending until rebuilt
+func (c *EsClient) ensureIndex() error {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.current != "" {
+		return nil
+	}
+
+	target := c.versionIndex()
+
+	current, err := c.aliasIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := c.createIndex(target); err != nil {
+		return err
+	}
+
+	switch current {
+	case target:
+		c.current = target
+
+	// nothing to rebuild from
+	case "":
+		if _, err := c.client().Alias().Add(target, c.index).Do(ctx); err != nil {
+			return err
+		}
+		c.current = target
+		logrus.Infof("EsClient: Alias %s -> %s", c.index, target)
+
+	default:
+		c.current = current
+		c.pending = target
+		logrus.Infof("EsClient: Index %s pending rebuild from %s", target, current)
+	}
+
+	return nil
+}
+
+// block until the index is first set up
+// returns false if ctx is done first
+func (c *EsClient) indexWait() bool {
+	select {
+	case <-c.indexReady:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// index waiting to be filled before the alias is switched to it
+// empty if the alias already points to the current mapping version
+func (c *EsClient) PendingIndex() string {
+	c.indexWait()
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	return c.pending
+}
+
+// indices updates are written to
+// updates go to both the live index and the one being rebuilt so neither misses changes
+// waits for the index to be set up and falls back to the current version on shutdown
+// so updates are still dead-lettered with an index
+func (c *EsClient) writeIndices() []string {
+	if !c.indexWait() {
+		return []string{c.versionIndex()}
+	}
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.pending != "" {
+		return []string{c.current, c.pending}
+	}
+	return []string{c.current}
+}
+
+// index searches go to
+// the rebuilt index while the alias replaces an old index of the same name
+func (c *EsClient) searchIndex() string {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.searching != "" {
+		return c.searching
+	}
+	return c.index
+}
+
+// send queued updates with a time limit so a failing flush can't hold up the swap forever
+func (c *EsClient) flushSwap() error {
+	ctx, cancel := context.WithTimeout(c.ctx, swapFlushTimeout)
+	defer cancel()
+
+	return c.bulk.flushWait(ctx)
+}
+
+// flush pending updates and point the alias to the rebuilt index
+// writers are only held up for the switch of current and pending
+func (c *EsClient) SwapAlias() error {
+	if err := c.flushSwap(); err != nil {
+		return err
+	}
+
+	c.indexLock.Lock()
+	old, target := c.current, c.pending
+	if target == "" {
+		c.indexLock.Unlock()
+		return nil
+	}
+
+	if old == c.index {
+		// an alias can't have the same name as an index so the old index has to go first
+		// searches go straight to the rebuilt index until the alias exists
+		c.searching = target
+	} else {
+		// single request so the alias switches atomically
+		_, err := c.client().Alias().
+			Remove(old, c.index).
+			Add(target, c.index).
+			Do(ctx)
+		if err != nil {
+			c.indexLock.Unlock()
+			return err
+		}
+	}
+
+	// new updates only go to the rebuilt index
+	c.current = target
+	c.pending = ""
+	c.indexLock.Unlock()
+
+	// updates queued for the old index before the switch
+	if err := c.flushSwap(); err != nil {
+		logrus.Errorf("EsClient: Flush before deleting %s: %v", old, err)
+	}
+
+	if _, err := c.client().DeleteIndex(old).Do(ctx); err != nil {
+		if old == c.index {
+			return err
+		}
+		logrus.Errorf("EsClient: Delete old index %s: Failed: %v", old, err)
+	}
+
+	if old == c.index {
+		if _, err := c.client().Alias().Add(target, c.index).Do(ctx); err != nil {
+			return err
+		}
+
+		c.indexLock.Lock()
+		c.searching = ""
+		c.indexLock.Unlock()
+	}
+
+	logrus.Infof("EsClient: Alias %s -> %s", c.index, target)
+	return nil
+}
+
+// add document to next bulk update of one index only
+// used to fill the pending index
+func (c *EsClient) IndexBulkTo(index, id string, s interface{}) {
+	c.bulk.add(BulkAction{Op: "index", Index: index, Id: id, Doc: s})
+}
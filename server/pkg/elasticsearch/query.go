@@ -0,0 +1,121 @@
+//
+// translate parsed search queries to elasticsearch queries
+//
+
+package elasticsearch
+
+import (
+	"strings"
+
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// bool query from parsed clauses
+// free text words are matched together across search fields
+// field terms narrow results and -terms exclude them
+func (c *EsClient) parsedQuery(q *query.Query) elastic.Query {
+	if q.Empty() {
+		return elastic.NewMatchAllQuery()
+	}
+
+	b := elastic.NewBoolQuery()
+
+	var words []string
+	for _, clause := range q.Clauses {
+		if clause.Field == nil && !clause.Phrase && !clause.Negate {
+			words = append(words, clause.Value)
+			continue
+		}
+
+		cq := c.clauseQuery(clause)
+
+		switch {
+		case clause.Negate:
+			b.MustNot(cq)
+
+		// text matches count towards score
+		case clause.Field == nil || clause.Field.Kind == query.Text:
+			b.Must(cq)
+
+		default:
+			b.Filter(cq)
+		}
+	}
+
+	if len(words) > 0 {
+		b.Must(c.textQuery(strings.Join(words, " ")))
+	}
+
+	return b
+}
+
+func (c *EsClient) clauseQuery(clause query.Clause) elastic.Query {
+	if clause.Field == nil {
+		mq := elastic.NewMultiMatchQuery(clause.Value, c.searchFields...).
+			Operator("and")
+		if clause.Phrase {
+			mq = mq.Type("phrase")
+		}
+		return mq
+	}
+
+	field := clause.Field.Name
+
+	switch clause.Field.Kind {
+	case query.Text:
+		if clause.Phrase {
+			return elastic.NewMatchPhraseQuery(field, clause.Value)
+		}
+		return elastic.NewMatchQuery(field, clause.Value).
+			Operator("and")
+
+	case query.Number, query.Date:
+		value, to := rangeValue(clause.Field, clause.Value), rangeValue(clause.Field, clause.To)
+
+		switch clause.Op {
+		case query.OpGreater:
+			return elastic.NewRangeQuery(field).Gt(value)
+		case query.OpGreaterEqual:
+			return elastic.NewRangeQuery(field).Gte(value)
+		case query.OpLess:
+			return elastic.NewRangeQuery(field).Lt(value)
+		case query.OpLessEqual:
+			return elastic.NewRangeQuery(field).Lte(value)
+		case query.OpRange:
+			rq := elastic.NewRangeQuery(field)
+			if clause.Value != "" {
+				rq = rq.Gte(value)
+			}
+			if clause.To != "" {
+				rq = rq.Lte(to)
+			}
+			return rq
+		}
+
+		// partial dates match the whole year or month
+		if clause.Field.Kind == query.Date {
+			return elastic.NewRangeQuery(field).
+				Gte(value).
+				Lte(value)
+		}
+	}
+
+	return elastic.NewTermQuery(field, clause.Value)
+}
+
+// round partial dates to their unit so that
+// lte 1960 includes all of 1960 and gt 1960 starts at 1961
+func rangeValue(field *query.Field, value string) string {
+	if field.Kind != query.Date || value == "" {
+		return value
+	}
+
+	switch len(value) {
+	case len("yyyy"):
+		return value + "||/y"
+	case len("yyyy-MM"):
+		return value + "||/M"
+	}
+	return value + "||/d"
+}
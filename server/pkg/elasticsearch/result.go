@@ -0,0 +1,98 @@
+//
+// search results returned to API clients
+//
+
+package elasticsearch
+
+import (
+	"strings"
+
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// stable order for paging
+// file is unique so documents with the same score keep their order
+func searchSort() []elastic.Sorter {
+	return []elastic.Sorter{
+		elastic.NewScoreSort().Desc(),
+		elastic.NewFieldSort("file").Asc(),
+	}
+}
+
+// highlight every search field and the sub fields text queries match on
+func (c *EsClient) highlight() *elastic.Highlight {
+	var fields []*elastic.HighlighterField
+	for _, f := range c.searchFields {
+		fields = append(fields,
+			elastic.NewHighlighterField(f),
+			elastic.NewHighlighterField(f+".exact"),
+			elastic.NewHighlighterField(f+".cjk"))
+	}
+
+	return elastic.NewHighlight().
+		Fields(fields...).
+		PreTags(search.HighlightPreTag).
+		PostTags(search.HighlightPostTag).
+		NumOfFragments(search.HighlightFragments).
+		FragmentSize(search.HighlightFragmentSize)
+}
+
+func newSearchResult(result *elastic.SearchResult, start, size int) *search.Result {
+	r := &search.Result{
+		Hits:  []search.Hit{},
+		Start: start,
+		Took:  result.TookInMillis,
+	}
+
+	if result.Hits == nil {
+		return r
+	}
+	r.Total = result.Hits.TotalHits
+
+	for _, hit := range result.Hits.Hits {
+		h := search.Hit{
+			Id:        hit.Id,
+			Song:      hit.Source,
+			Highlight: mergeHighlight(hit.Highlight),
+		}
+		if hit.Score != nil {
+			h.Score = *hit.Score
+		}
+		r.Hits = append(r.Hits, h)
+	}
+
+	if n := len(result.Hits.Hits); n > 0 && n == size && int64(start+n) < r.Total {
+		r.Cursor = search.EncodeCursor(result.Hits.Hits[n-1].Sort)
+	}
+
+	return r
+}
+
+// key fragments by the field name clients know
+// the same text matched through sub fields is listed once
+func mergeHighlight(highlight elastic.SearchHitHighlight) map[string][]string {
+	if len(highlight) == 0 {
+		return nil
+	}
+
+	merged := make(map[string][]string)
+	seen := make(map[string]struct{})
+
+	for field, fragments := range highlight {
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[:i]
+		}
+
+		for _, f := range fragments {
+			key := field + "\x00" + f
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			merged[field] = append(merged[field], f)
+		}
+	}
+
+	return merged
+}
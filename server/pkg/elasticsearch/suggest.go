@@ -0,0 +1,109 @@
+//
+// search as you type suggestions
+//
+
+package elasticsearch
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// distinct values of each field starting with the typed words
+// one request with a filtered terms aggregation per field and no hits
+// the filter finds documents and include keeps only their values that match
+// as documents with multi valued fields have values that don't
+func (c *EsClient) Suggest(text string, fields []search.SuggestField, size int) ([]search.Suggestion, error) {
+	s := c.client().Search().
+		Index(c.searchIndex()).
+		Type(c.indexType).
+		Size(0)
+
+	include := suggestInclude(text)
+
+	for _, f := range fields {
+		values := elastic.NewTermsAggregation().
+			Field(f.Value).
+			Size(size)
+		if include != "" {
+			values = values.Include(include)
+		}
+
+		s = s.Aggregation(f.Type, elastic.NewFilterAggregation().
+			Filter(elastic.NewMatchQuery(f.Match, text).Operator("and")).
+			SubAggregation("values", values))
+	}
+
+	result, err := s.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var suggestions []search.Suggestion
+	for _, f := range fields {
+		filter, ok := result.Aggregations.Filter(f.Type)
+		if !ok {
+			continue
+		}
+
+		values, ok := filter.Terms("values")
+		if !ok {
+			continue
+		}
+
+		for _, b := range values.Buckets {
+			value, ok := b.Key.(string)
+			if !ok {
+				continue
+			}
+
+			suggestions = append(suggestions, search.Suggestion{
+				Type:  f.Type,
+				Value: value,
+				Count: b.DocCount,
+			})
+		}
+	}
+
+	return suggestions, nil
+}
+
+// Lucene regular expression for values with a word starting with each of the typed words in any order
+// e.g. "da mi" keeps "Miles Davis" but not "Damian Marley" or "Mia"
+// letters match either case and words not starting with a letter or digit e.g. CJK can start anywhere
+func suggestInclude(text string) string {
+	var parts []string
+
+	for _, w := range strings.Fields(text) {
+		var b strings.Builder
+
+		first, _ := utf8.DecodeRuneInString(w)
+		if first < utf8.RuneSelf && (unicode.IsLetter(first) || unicode.IsDigit(first)) {
+			b.WriteString("(.*[^a-zA-Z0-9])?")
+		} else {
+			b.WriteString(".*")
+		}
+
+		for _, r := range w {
+			lower, upper := unicode.ToLower(r), unicode.ToUpper(r)
+			switch {
+			case lower != upper:
+				b.WriteString("[" + string(lower) + string(upper) + "]")
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				b.WriteRune(r)
+			default:
+				b.WriteString("\\" + string(r))
+			}
+		}
+		b.WriteString(".*")
+
+		parts = append(parts, b.String())
+	}
+
+	// & is intersection in Lucene regular expressions
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,61 @@
+package elasticsearch
+
+import (
+	"regexp"
+	"testing"
+)
+
+// match value as ES would against each intersected part
+// split on & not escaped with a backslash
+func includeMatch(include, value string) bool {
+	var parts []string
+	start := 0
+	for i := 0; i < len(include); i++ {
+		switch include[i] {
+		case '\\':
+			i++
+		case '&':
+			parts = append(parts, include[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, include[start:])
+
+	for _, part := range parts {
+		if !regexp.MustCompile("^(?:" + part + ")$").MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSuggestInclude(t *testing.T) {
+	tests := []struct {
+		text  string
+		value string
+		want  bool
+	}{
+		{"b", "Bxx", true},
+		{"b", "A", false},
+		{"da mi", "Miles Davis", true},
+		{"da mi", "Damian Marley", false},
+		{"da mi", "Mia", false},
+		{"DAVIS", "Miles Davis", true},
+		{"ac/d", "AC/DC", true},
+		{"(live", "Walkin' (Live)", true},
+		{"a&b", "a&b", true},
+		{"龍", "坂本龍一", true},
+		{"龍", "東京", false},
+	}
+
+	for _, tt := range tests {
+		include := suggestInclude(tt.text)
+		if got := includeMatch(include, tt.value); got != tt.want {
+			t.Errorf("suggestInclude(%q) = %q matching %q: got %v, want %v", tt.text, include, tt.value, got, tt.want)
+		}
+	}
+
+	if include := suggestInclude("  "); include != "" {
+		t.Errorf("suggestInclude of no words = %q, want empty", include)
+	}
+}
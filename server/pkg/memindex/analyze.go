@@ -0,0 +1,206 @@
+//
+// text analysis matching the elasticsearch mapping
+// words are lower cased with accents removed and CJK text is split into bigrams
+//
+
+package memindex
+
+import (
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+type token struct {
+	term string
+	// position in field counting across values
+	pos int
+	// value index and byte offsets in the original value for highlights
+	value      int
+	start, end int
+}
+
+// gap between positions of values in a multi valued field so phrases don't cross values
+const valueGap = 100
+
+// transform chains keep state so each is used by one goroutine at a time
+var folders = sync.Pool{
+	New: func() interface{} {
+		return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	},
+}
+
+// lower case without accents
+func fold(s string) string {
+	folder := folders.Get().(transform.Transformer)
+	defer folders.Put(folder)
+
+	folded, _, err := transform.String(folder, s)
+	if err != nil {
+		folded = s
+	}
+	return toLower(folded)
+}
+
+func toLower(s string) string {
+	b := make([]rune, 0, len(s))
+	for _, r := range s {
+		b = append(b, unicode.ToLower(r))
+	}
+	return string(b)
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokens of each value of a field
+func analyze(values []string) []token {
+	var tokens []token
+	pos := 0
+	for i, v := range values {
+		tokens = analyzeValue(tokens, v, i, pos)
+		pos = valueGap * (i + 1)
+		if n := len(tokens); n > 0 && tokens[n-1].pos >= pos {
+			pos = tokens[n-1].pos + valueGap
+		}
+	}
+	return tokens
+}
+
+// terms of query text
+func analyzeText(text string) []string {
+	var terms []string
+	for _, t := range analyzeValue(nil, text, 0, 0) {
+		terms = append(terms, t.term)
+	}
+	return terms
+}
+
+// split on anything but letters and digits
+// runs of CJK characters become overlapping bigrams like the cjk analyzer
+func analyzeValue(tokens []token, value string, index, pos int) []token {
+	i := 0
+	for i < len(value) {
+		r, size := utf8.DecodeRuneInString(value[i:])
+
+		switch {
+		case isCJK(r):
+			start := i
+			var offsets []int
+			for i < len(value) {
+				r, size := utf8.DecodeRuneInString(value[i:])
+				if !isCJK(r) {
+					break
+				}
+				offsets = append(offsets, i)
+				i += size
+			}
+			offsets = append(offsets, i)
+
+			if len(offsets) == 2 {
+				tokens = append(tokens, token{fold(value[start:i]), pos, index, start, i})
+				pos++
+				continue
+			}
+			for j := 0; j+2 < len(offsets); j++ {
+				s, e := offsets[j], offsets[j+2]
+				tokens = append(tokens, token{fold(value[s:e]), pos, index, s, e})
+				pos++
+			}
+
+		case isWord(r):
+			start := i
+			for i < len(value) {
+				r, size := utf8.DecodeRuneInString(value[i:])
+				if !isWord(r) || isCJK(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{fold(value[start:i]), pos, index, start, i})
+			pos++
+
+		default:
+			i += size
+		}
+	}
+	return tokens
+}
+
+// edits allowed for fuzzy matching a term of this length like fuzziness AUTO
+func fuzziness(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	}
+	return 2
+}
+
+// true if a and b are within max edits sharing the first character
+func fuzzyMatch(a, b string, max int) bool {
+	if a == b {
+		return true
+	}
+	if max == 0 {
+		return false
+	}
+
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 || len(rb) == 0 || ra[0] != rb[0] {
+		return false
+	}
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return false
+	}
+
+	// levenshtein distance by rows stopping once every cell is over max
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		low := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < low {
+				low = cur[j]
+			}
+		}
+		if low > max {
+			return false
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)] <= max
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,456 @@
+//
+// embedded full text index for installs without elasticsearch
+// documents are kept in memory and optionally logged to a file to survive restarts
+//
+
+package memindex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/sirupsen/logrus"
+)
+
+var _ search.Backend = (*Index)(nil)
+var _ search.Closer = (*Index)(nil)
+
+type Index struct {
+	searchFields []string
+
+	lock sync.RWMutex
+	docs map[string]*document
+	// document ids by term in any search field
+	postings map[string]map[string]struct{}
+
+	// append only log of updates, nil if not persisted
+	path    string
+	logLock sync.Mutex
+	file    *os.File
+	log     *bufio.Writer
+	// bytes in the log and in it right after the last compaction
+	logSize       int64
+	compactedSize int64
+
+	// closed by Close to stop runFlush and closed by runFlush once stopped
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type document struct {
+	id     string
+	source json.RawMessage
+	// values as strings by field with numbers formatted
+	values map[string][]string
+	// values as decoded from JSON for facet keys
+	raw map[string][]interface{}
+	// tokens of search fields
+	tokens map[string][]token
+}
+
+// one line of the update log
+type logEntry struct {
+	Id     string          `json:"id"`
+	Delete bool            `json:"delete,omitempty"`
+	Doc    json.RawMessage `json:"doc,omitempty"`
+}
+
+// interval buffered log writes are flushed
+const flushInterval = 2 * time.Second
+
+// log is compacted on flush once past this size and twice its compacted size
+var compactMinSize int64 = 16 << 20
+
+// new index searching searchFields
+// documents are loaded from path and updates appended to it unless path is empty
+func New(path string, searchFields []string) (*Index, error) {
+	logrus.Infof("MemIndex: Start")
+
+	c := &Index{
+		searchFields: searchFields,
+		docs:         make(map[string]*document),
+		postings:     make(map[string]map[string]struct{}),
+		path:         path,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	if path == "" {
+		close(c.stopped)
+		return c, nil
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+
+	go c.runFlush()
+	return c, nil
+}
+
+//
+// Update index
+//
+
+// add or replace document
+func (c *Index) IndexBulk(id string, s interface{}) {
+	source, err := json.Marshal(s)
+	if err != nil {
+		logrus.Errorf("MemIndex: Index %s: Failed: %v", id, err)
+		return
+	}
+
+	doc, err := c.newDocument(id, source)
+	if err != nil {
+		logrus.Errorf("MemIndex: Index %s: Failed: %v", id, err)
+		return
+	}
+
+	// logged under the same lock so the log has updates of an id in the order they were applied
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.remove(id)
+	c.add(doc)
+	c.append(logEntry{Id: id, Doc: source})
+}
+
+// remove document
+func (c *Index) DeleteBluk(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.remove(id)
+	c.append(logEntry{Id: id, Delete: true})
+}
+
+// call fn with the id of every document in the index
+func (c *Index) ScrollIds(fn func(id string)) error {
+	c.lock.RLock()
+	ids := make([]string, 0, len(c.docs))
+	for id := range c.docs {
+		ids = append(ids, id)
+	}
+	c.lock.RUnlock()
+
+	for _, id := range ids {
+		fn(id)
+	}
+	return nil
+}
+
+// indexed document or nil if not found
+func (c *Index) Get(id string) (*json.RawMessage, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	doc, ok := c.docs[id]
+	if !ok {
+		return nil, nil
+	}
+
+	source := json.RawMessage(append([]byte(nil), doc.source...))
+	return &source, nil
+}
+
+func (c *Index) newDocument(id string, source json.RawMessage) (*document, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(source, &fields); err != nil {
+		return nil, err
+	}
+
+	doc := &document{
+		id:     id,
+		source: source,
+		values: make(map[string][]string),
+		raw:    make(map[string][]interface{}),
+		tokens: make(map[string][]token),
+	}
+
+	for field, v := range fields {
+		var values []interface{}
+		switch v := v.(type) {
+		case []interface{}:
+			values = v
+		default:
+			values = []interface{}{v}
+		}
+
+		for _, value := range values {
+			var s string
+			switch value := value.(type) {
+			case string:
+				s = value
+			case float64:
+				s = strconv.FormatFloat(value, 'f', -1, 64)
+			case bool:
+				s = strconv.FormatBool(value)
+			default:
+				// nested objects are not searchable
+				continue
+			}
+			doc.values[field] = append(doc.values[field], s)
+			doc.raw[field] = append(doc.raw[field], value)
+		}
+	}
+
+	for _, field := range c.searchFields {
+		if values, ok := doc.values[field]; ok {
+			doc.tokens[field] = analyze(values)
+		}
+	}
+
+	return doc, nil
+}
+
+// caller holds lock
+func (c *Index) add(doc *document) {
+	c.docs[doc.id] = doc
+
+	for _, tokens := range doc.tokens {
+		for _, t := range tokens {
+			ids, ok := c.postings[t.term]
+			if !ok {
+				ids = make(map[string]struct{})
+				c.postings[t.term] = ids
+			}
+			ids[doc.id] = struct{}{}
+		}
+	}
+}
+
+// caller holds lock
+func (c *Index) remove(id string) {
+	doc, ok := c.docs[id]
+	if !ok {
+		return
+	}
+	delete(c.docs, id)
+
+	for _, tokens := range doc.tokens {
+		for _, t := range tokens {
+			if ids, ok := c.postings[t.term]; ok {
+				delete(ids, id)
+				if len(ids) == 0 {
+					delete(c.postings, t.term)
+				}
+			}
+		}
+	}
+}
+
+//
+// persist updates
+//
+
+// replay update log
+func (c *Index) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var e logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a write cut off by a crash leaves a partial last line
+			logrus.Errorf("MemIndex: Skip bad line %d in %s: %v", line, c.path, err)
+			continue
+		}
+
+		c.remove(e.Id)
+		if e.Delete {
+			continue
+		}
+
+		doc, err := c.newDocument(e.Id, e.Doc)
+		if err != nil {
+			logrus.Errorf("MemIndex: Skip bad line %d in %s: %v", line, c.path, err)
+			continue
+		}
+		c.add(doc)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	logrus.Infof("MemIndex: Loaded %d documents from %s", len(c.docs), c.path)
+	return nil
+}
+
+// rewrite log with only current documents and open it for appending
+// callers hold lock then logLock so no update is applied but missed
+func (c *Index) compact() error {
+	tmp := c.path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(c.docs))
+	for id := range c.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		if err = enc.Encode(logEntry{Id: id, Doc: c.docs[id].source}); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// updates buffered for the old log are in the rewritten one
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file = file
+	c.log = bufio.NewWriter(file)
+	c.logSize = info.Size()
+	c.compactedSize = info.Size()
+	return nil
+}
+
+func (c *Index) append(e logEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		logrus.Errorf("MemIndex: Write %s: Failed: %v", e.Id, err)
+		return
+	}
+
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+
+	if c.log == nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(c.log, "%s\n", b)
+	if err != nil {
+		logrus.Errorf("MemIndex: Write %s: Failed: %v", e.Id, err)
+	}
+	c.logSize += int64(n)
+}
+
+// write buffered updates
+// the log is compacted once replaced and deleted documents take up most of it
+func (c *Index) Flush() error {
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+
+	if c.log == nil {
+		return nil
+	}
+	if err := c.log.Flush(); err != nil {
+		return err
+	}
+
+	if c.logSize <= compactMinSize || c.logSize <= 2*c.compactedSize {
+		return nil
+	}
+
+	// lock has to be taken before logLock
+	c.logLock.Unlock()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	c.logLock.Lock()
+
+	// closed in between
+	if c.log == nil {
+		return nil
+	}
+
+	logrus.Infof("MemIndex: Compact %s: %d bytes", c.path, c.logSize)
+	return c.compact()
+}
+
+// stop flushing on interval, write buffered updates and close the log
+// local writes are not cut short by ctx
+func (c *Index) Close(ctx context.Context) error {
+	close(c.done)
+	<-c.stopped
+
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+
+	if c.log == nil {
+		return nil
+	}
+	if err := c.log.Flush(); err != nil {
+		return err
+	}
+	c.log = nil
+	return c.file.Close()
+}
+
+// flush on interval until Close
+func (c *Index) runFlush() {
+	defer close(c.stopped)
+
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-c.done:
+			return
+		}
+
+		if err := c.Flush(); err != nil {
+			logrus.Errorf("MemIndex: Flush: Failed: %v", err)
+		}
+	}
+}
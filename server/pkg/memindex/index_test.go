@@ -0,0 +1,168 @@
+package memindex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/randomcoww/go-mpd-es/pkg/search/searchtest"
+)
+
+func newTestIndex(t *testing.T, path string) *Index {
+	c, err := New(path, searchtest.SearchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range searchtest.Songs {
+		c.IndexBulk(s.File, s)
+	}
+	return c
+}
+
+func TestSearch(t *testing.T) {
+	searchtest.Run(t, func(t *testing.T) search.Searcher {
+		return newTestIndex(t, "")
+	})
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.log")
+
+	c := newTestIndex(t, path)
+	c.DeleteBluk("f.flac")
+	c.IndexBulk("a.flac", searchtest.Song{File: "a.flac", Title: "So What (Remastered)"})
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(path, c.searchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	reopened.ScrollIds(func(id string) {
+		ids = append(ids, id)
+	})
+	sort.Strings(ids)
+
+	if want := []string{"a.flac", "b.flac", "c.flac", "d.flac", "e.flac"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("reopened ids = %v, want %v", ids, want)
+	}
+
+	var song searchtest.Song
+	if err := json.Unmarshal(reopened.docs["a.flac"].source, &song); err != nil {
+		t.Fatal(err)
+	}
+	if song.Title != "So What (Remastered)" {
+		t.Errorf("reopened title = %q", song.Title)
+	}
+}
+
+func TestCompactOnFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { compactMinSize = size }(compactMinSize)
+	compactMinSize = 1024
+
+	path := filepath.Join(dir, "index.log")
+
+	c := newTestIndex(t, path)
+	defer c.Close(context.Background())
+
+	for i := 0; i < 100; i++ {
+		c.IndexBulk("a.flac", searchtest.Song{File: "a.flac", Title: fmt.Sprintf("So What %d", i)})
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != len(searchtest.Songs) {
+		t.Errorf("log has %d lines after compaction, want %d", lines, len(searchtest.Songs))
+	}
+
+	// appends after compaction go to the new log
+	c.DeleteBluk("f.flac")
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(path, c.searchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+
+	if n := len(reopened.docs); n != len(searchtest.Songs)-1 {
+		t.Errorf("reopened %d documents, want %d", n, len(searchtest.Songs)-1)
+	}
+	var song searchtest.Song
+	if err := json.Unmarshal(reopened.docs["a.flac"].source, &song); err != nil {
+		t.Fatal(err)
+	}
+	if song.Title != "So What 99" {
+		t.Errorf("reopened title = %q", song.Title)
+	}
+}
+
+func TestPersistConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.log")
+
+	c := newTestIndex(t, path)
+	defer c.Close(context.Background())
+
+	// same id written from two goroutines as by the log indexer and reconciler
+	done := make(chan struct{})
+	for w := 0; w < 2; w++ {
+		go func(w int) {
+			for i := 0; i < 200; i++ {
+				c.IndexBulk("a.flac", searchtest.Song{File: "a.flac", Title: fmt.Sprintf("So What %d-%d", w, i)})
+			}
+			done <- struct{}{}
+		}(w)
+	}
+	<-done
+	<-done
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(path, c.searchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+
+	if got, want := string(reopened.docs["a.flac"].source), string(c.docs["a.flac"].source); got != want {
+		t.Errorf("reopened %s, in memory %s", got, want)
+	}
+}
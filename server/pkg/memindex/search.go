@@ -0,0 +1,751 @@
+//
+// queries against the embedded index
+// follows the elasticsearch backend: all words of free text must match in one search field,
+// allowing typos, and field terms narrow results
+//
+
+package memindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+)
+
+// result size if none is given
+const defaultSize = 10
+
+type hit struct {
+	doc   *document
+	score float64
+	// matched terms by field for highlights
+	terms map[string]map[string]struct{}
+}
+
+// compiled query
+type matcher struct {
+	c       *Index
+	clauses []query.Clause
+	// free text terms with the index terms each may match as
+	// true for exact matches
+	words      []string
+	expansions []map[string]bool
+	filters    map[string][]string
+	matchAll   bool
+}
+
+// search with scores and highlighted matches
+// pages continue from cursor if set and from start otherwise
+func (c *Index) Search(q *query.Query, filters map[string][]string, cursor string, start, size int) (*search.Result, error) {
+	begin := time.Now()
+
+	if size < 0 {
+		size = defaultSize
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	hits := c.newMatcher(q, filters).hits()
+
+	from := start
+	if cursor != "" {
+		after, err := search.DecodeCursor(cursor, 2)
+		if err != nil {
+			return nil, err
+		}
+		score, ok1 := after[0].(float64)
+		id, ok2 := after[1].(string)
+		if !ok1 || !ok2 {
+			return nil, search.ErrInvalidCursor
+		}
+
+		from = sort.Search(len(hits), func(i int) bool {
+			return hits[i].score < score || (hits[i].score == score && hits[i].doc.id > id)
+		})
+	}
+
+	if from > len(hits) {
+		from = len(hits)
+	}
+	to := from + size
+	if to > len(hits) {
+		to = len(hits)
+	}
+
+	r := &search.Result{
+		Hits:  make([]search.Hit, 0, to-from),
+		Start: start,
+		Total: int64(len(hits)),
+	}
+
+	for _, h := range hits[from:to] {
+		r.Hits = append(r.Hits, c.newHit(h, true))
+	}
+
+	if to > from && to < len(hits) {
+		last := hits[to-1]
+		r.Cursor = search.EncodeCursor([]interface{}{last.score, last.doc.id})
+	}
+
+	r.Took = int64(time.Since(begin) / time.Millisecond)
+	return r, nil
+}
+
+// call fn for every search result in order without highlights
+func (c *Index) Export(q *query.Query, filters map[string][]string, fn func(search.Hit) error) error {
+	c.lock.RLock()
+	hits := c.newMatcher(q, filters).hits()
+
+	results := make([]search.Hit, len(hits))
+	for i, h := range hits {
+		results[i] = c.newHit(h, false)
+	}
+	c.lock.RUnlock()
+
+	for _, h := range results {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count documents per value of each facet
+// fields maps facet names to keyword or numeric fields
+// filters holds values already chosen per facet and narrows all counts
+func (c *Index) Facets(q *query.Query, fields map[string]string, filters map[string][]string, size int) (map[string][]search.FacetBucket, error) {
+	fieldFilters := make(map[string][]string)
+	for name, values := range filters {
+		if field, ok := fields[name]; ok {
+			fieldFilters[field] = values
+		}
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	hits := c.newMatcher(q, fieldFilters).hits()
+
+	facets := make(map[string][]search.FacetBucket)
+	for name, field := range fields {
+		facets[name] = countValues(hits, baseField(field), size)
+	}
+	return facets, nil
+}
+
+// distinct values of each field starting with the typed words
+func (c *Index) Suggest(text string, fields []search.SuggestField, size int) ([]search.Suggestion, error) {
+	terms := analyzeText(text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var suggestions []search.Suggestion
+	for _, f := range fields {
+		match := baseField(f.Match)
+
+		var hits []*hit
+		for _, doc := range c.docs {
+			if hasPrefixes(c.fieldTokens(doc, match), terms) {
+				hits = append(hits, &hit{doc: doc})
+			}
+		}
+
+		for _, b := range countValues(hits, baseField(f.Value), size) {
+			value, ok := b.Value.(string)
+			if !ok {
+				continue
+			}
+
+			suggestions = append(suggestions, search.Suggestion{
+				Type:  f.Type,
+				Value: value,
+				Count: b.Count,
+			})
+		}
+	}
+
+	return suggestions, nil
+}
+
+//
+// matching
+//
+
+// caller holds lock
+func (c *Index) newMatcher(q *query.Query, filters map[string][]string) *matcher {
+	m := &matcher{
+		c:        c,
+		filters:  filters,
+		matchAll: q.Empty(),
+	}
+
+	if q.Empty() {
+		return m
+	}
+
+	for _, clause := range q.Clauses {
+		if clause.Field == nil && !clause.Phrase && !clause.Negate {
+			m.words = append(m.words, analyzeText(clause.Value)...)
+			continue
+		}
+		m.clauses = append(m.clauses, clause)
+	}
+
+	for _, word := range m.words {
+		m.expansions = append(m.expansions, c.expand(word))
+	}
+
+	return m
+}
+
+// index terms within the allowed edits of word
+// caller holds lock
+func (c *Index) expand(word string) map[string]bool {
+	terms := map[string]bool{word: true}
+
+	max := fuzziness(word)
+	if max == 0 {
+		return terms
+	}
+
+	for term := range c.postings {
+		if term != word && fuzzyMatch(word, term, max) {
+			terms[term] = false
+		}
+	}
+	return terms
+}
+
+// matching documents by score and id
+func (m *matcher) hits() []*hit {
+	var hits []*hit
+	for _, doc := range m.candidates() {
+		if h, ok := m.match(doc); ok {
+			hits = append(hits, h)
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].doc.id < hits[j].doc.id
+	})
+	return hits
+}
+
+// documents containing every free text word or all documents if there are none
+func (m *matcher) candidates() []*document {
+	if len(m.words) == 0 {
+		docs := make([]*document, 0, len(m.c.docs))
+		for _, doc := range m.c.docs {
+			docs = append(docs, doc)
+		}
+		return docs
+	}
+
+	var ids map[string]struct{}
+	for _, terms := range m.expansions {
+		found := make(map[string]struct{})
+		for term := range terms {
+			for id := range m.c.postings[term] {
+				if ids == nil {
+					found[id] = struct{}{}
+				} else if _, ok := ids[id]; ok {
+					found[id] = struct{}{}
+				}
+			}
+		}
+		ids = found
+	}
+
+	docs := make([]*document, 0, len(ids))
+	for id := range ids {
+		docs = append(docs, m.c.docs[id])
+	}
+	return docs
+}
+
+func (m *matcher) match(doc *document) (*hit, bool) {
+	h := &hit{
+		doc:   doc,
+		terms: make(map[string]map[string]struct{}),
+	}
+
+	for field, values := range m.filters {
+		if len(values) > 0 && !hasValue(doc.values[baseField(field)], values) {
+			return nil, false
+		}
+	}
+
+	if m.matchAll {
+		h.score = 1
+		return h, true
+	}
+
+	if len(m.words) > 0 && !m.matchWords(doc, h) {
+		return nil, false
+	}
+
+	for _, clause := range m.clauses {
+		if m.matchClause(doc, clause, h) == clause.Negate {
+			return nil, false
+		}
+	}
+
+	return h, true
+}
+
+// all words in the same search field scored on the best field
+// exact matches score above typos and the words in order score highest
+func (m *matcher) matchWords(doc *document, h *hit) bool {
+	best := 0.0
+	var bestField string
+	var bestTerms map[string]struct{}
+
+	for _, field := range m.c.searchFields {
+		tokens := doc.tokens[field]
+		if len(tokens) == 0 {
+			continue
+		}
+
+		score := 0.0
+		terms := make(map[string]struct{})
+		exact := make([]string, len(m.words))
+
+		for i, expansion := range m.expansions {
+			weight := 0.0
+			for _, t := range tokens {
+				isExact, ok := expansion[t.term]
+				if !ok {
+					continue
+				}
+				terms[t.term] = struct{}{}
+
+				w := m.c.idf(t.term)
+				if isExact {
+					w *= 2
+					exact[i] = t.term
+				}
+				if w > weight {
+					weight = w
+				}
+			}
+			if weight == 0 {
+				score = 0
+				break
+			}
+			score += weight
+		}
+
+		if score > 0 && hasPhrase(tokens, exact) {
+			score *= 2
+		}
+
+		if score > best {
+			best, bestField, bestTerms = score, field, terms
+		}
+	}
+
+	if best == 0 {
+		return false
+	}
+
+	h.score += best
+	h.addTerms(bestField, bestTerms)
+	return true
+}
+
+func (m *matcher) matchClause(doc *document, clause query.Clause, h *hit) bool {
+	if clause.Field == nil {
+		terms := analyzeText(clause.Value)
+		matched := false
+		for _, field := range m.c.searchFields {
+			if m.matchText(doc, field, terms, clause.Phrase, h, clause.Negate) {
+				matched = true
+			}
+		}
+		return matched
+	}
+
+	field := clause.Field.Name
+	values := doc.values[field]
+
+	switch clause.Field.Kind {
+	case query.Text:
+		return m.matchText(doc, field, analyzeText(clause.Value), clause.Phrase, h, clause.Negate)
+
+	case query.Number:
+		for _, v := range values {
+			n, err := strconv.ParseFloat(v, 64)
+			if err == nil && compareNumber(n, clause) {
+				return true
+			}
+		}
+		return false
+
+	case query.Date:
+		for _, v := range values {
+			if compareDate(v, clause) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return hasValue(values, []string{clause.Value})
+}
+
+// all terms in field or terms in order for phrases
+// matches of excluded terms are not scored
+func (m *matcher) matchText(doc *document, field string, terms []string, phrase bool, h *hit, negate bool) bool {
+	if len(terms) == 0 {
+		return false
+	}
+
+	tokens := m.c.fieldTokens(doc, field)
+	if phrase {
+		if !hasPhrase(tokens, terms) {
+			return false
+		}
+	} else if !hasTerms(tokens, terms) {
+		return false
+	}
+
+	if !negate {
+		matched := make(map[string]struct{})
+		for _, term := range terms {
+			h.score += m.c.idf(term)
+			matched[term] = struct{}{}
+		}
+		h.addTerms(field, matched)
+	}
+	return true
+}
+
+func (h *hit) addTerms(field string, terms map[string]struct{}) {
+	if h.terms[field] == nil {
+		h.terms[field] = make(map[string]struct{})
+	}
+	for term := range terms {
+		h.terms[field][term] = struct{}{}
+	}
+}
+
+// rarer terms score higher
+// caller holds lock
+func (c *Index) idf(term string) float64 {
+	df := len(c.postings[term])
+	if df == 0 {
+		df = 1
+	}
+	return math.Log(1 + float64(len(c.docs))/float64(df))
+}
+
+// tokens of a search field or of any text field analyzed on the fly
+func (c *Index) fieldTokens(doc *document, field string) []token {
+	if tokens, ok := doc.tokens[field]; ok {
+		return tokens
+	}
+	return analyze(doc.values[field])
+}
+
+func hasTerms(tokens []token, terms []string) bool {
+	for _, term := range terms {
+		found := false
+		for _, t := range tokens {
+			if t.term == term {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// terms at consecutive positions
+func hasPhrase(tokens []token, terms []string) bool {
+	if len(terms) == 0 {
+		return false
+	}
+	for _, term := range terms {
+		if term == "" {
+			return false
+		}
+	}
+
+	positions := make(map[int]string, len(tokens))
+	for _, t := range tokens {
+		positions[t.pos] = t.term
+	}
+
+	for _, t := range tokens {
+		if t.term != terms[0] {
+			continue
+		}
+
+		found := true
+		for i, term := range terms[1:] {
+			if positions[t.pos+i+1] != term {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// every term starts some token like an edge ngram match
+func hasPrefixes(tokens []token, terms []string) bool {
+	for _, term := range terms {
+		found := false
+		for _, t := range tokens {
+			if strings.HasPrefix(t.term, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func hasValue(values, want []string) bool {
+	for _, v := range values {
+		for _, w := range want {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareNumber(n float64, clause query.Clause) bool {
+	value, _ := strconv.ParseFloat(clause.Value, 64)
+
+	switch clause.Op {
+	case query.OpGreater:
+		return n > value
+	case query.OpGreaterEqual:
+		return n >= value
+	case query.OpLess:
+		return n < value
+	case query.OpLessEqual:
+		return n <= value
+	case query.OpRange:
+		to, _ := strconv.ParseFloat(clause.To, 64)
+		return (clause.Value == "" || n >= value) && (clause.To == "" || n <= to)
+	}
+	return n == value
+}
+
+// dates compare as yyyy-mm-dd strings
+// partial query dates cover their whole year or month and partial document dates start on the first day
+func compareDate(date string, clause query.Clause) bool {
+	d := firstDay(date)
+
+	switch clause.Op {
+	case query.OpGreater:
+		return d > lastDay(clause.Value)
+	case query.OpGreaterEqual:
+		return d >= firstDay(clause.Value)
+	case query.OpLess:
+		return d < firstDay(clause.Value)
+	case query.OpLessEqual:
+		return d <= lastDay(clause.Value)
+	case query.OpRange:
+		return (clause.Value == "" || d >= firstDay(clause.Value)) &&
+			(clause.To == "" || d <= lastDay(clause.To))
+	}
+	return d >= firstDay(clause.Value) && d <= lastDay(clause.Value)
+}
+
+func firstDay(date string) string {
+	switch len(date) {
+	case len("yyyy"):
+		return date + "-01-01"
+	case len("yyyy-MM"):
+		return date + "-01"
+	}
+	return date
+}
+
+// day numbers past the end of the month are fine for string comparison
+func lastDay(date string) string {
+	switch len(date) {
+	case len("yyyy"):
+		return date + "-12-31"
+	case len("yyyy-MM"):
+		return date + "-31"
+	}
+	return date
+}
+
+// field name without sub field
+// sub fields like keyword and suggest map to the same values here
+func baseField(field string) string {
+	if i := strings.Index(field, "."); i >= 0 {
+		return field[:i]
+	}
+	return field
+}
+
+// documents per value by count then value
+func countValues(hits []*hit, field string, size int) []search.FacetBucket {
+	counts := make(map[string]*search.FacetBucket)
+	for _, h := range hits {
+		seen := make(map[string]struct{})
+		for _, value := range h.doc.raw[field] {
+			key := fmt.Sprint(value)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			b, ok := counts[key]
+			if !ok {
+				b = &search.FacetBucket{Value: value}
+				counts[key] = b
+			}
+			b.Count++
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]].Count != counts[keys[j]].Count {
+			return counts[keys[i]].Count > counts[keys[j]].Count
+		}
+		return keys[i] < keys[j]
+	})
+
+	if size >= 0 && len(keys) > size {
+		keys = keys[:size]
+	}
+
+	buckets := make([]search.FacetBucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = *counts[key]
+	}
+	return buckets
+}
+
+//
+// results
+//
+
+// caller holds lock
+func (c *Index) newHit(h *hit, highlight bool) search.Hit {
+	source := json.RawMessage(append([]byte(nil), h.doc.source...))
+
+	result := search.Hit{
+		Id:    h.doc.id,
+		Score: h.score,
+		Song:  &source,
+	}
+	if highlight {
+		result.Highlight = c.highlight(h)
+	}
+	return result
+}
+
+// fragments of field values with matched terms wrapped in tags
+func (c *Index) highlight(h *hit) map[string][]string {
+	var highlight map[string][]string
+
+	for field, terms := range h.terms {
+		values := h.doc.values[field]
+
+		// matched tokens by value
+		matched := make(map[int][]token)
+		for _, t := range c.fieldTokens(h.doc, field) {
+			if _, ok := terms[t.term]; ok {
+				matched[t.value] = append(matched[t.value], t)
+			}
+		}
+
+		for i, value := range values {
+			tokens, ok := matched[i]
+			if !ok {
+				continue
+			}
+			if len(highlight[field]) >= search.HighlightFragments {
+				break
+			}
+
+			if highlight == nil {
+				highlight = make(map[string][]string)
+			}
+			highlight[field] = append(highlight[field], fragment(value, tokens))
+		}
+	}
+
+	return highlight
+}
+
+// value around the first match cut to fragment size
+func fragment(value string, tokens []token) string {
+	from, to := 0, len(value)
+	if len(value) > search.HighlightFragmentSize {
+		from = tokens[0].start - search.HighlightFragmentSize/4
+		if from < 0 {
+			from = 0
+		}
+		to = from + search.HighlightFragmentSize
+		if to > len(value) {
+			to = len(value)
+		}
+
+		for from > 0 && !utf8.RuneStart(value[from]) {
+			from--
+		}
+		for to < len(value) && !utf8.RuneStart(value[to]) {
+			to++
+		}
+	}
+
+	var b strings.Builder
+	pos := from
+	for _, t := range tokens {
+		// overlapping CJK bigrams or tokens outside the fragment
+		if t.start < pos || t.end > to {
+			continue
+		}
+		b.WriteString(value[pos:t.start])
+		b.WriteString(search.HighlightPreTag)
+		b.WriteString(value[t.start:t.end])
+		b.WriteString(search.HighlightPostTag)
+		pos = t.end
+	}
+	b.WriteString(value[pos:to])
+
+	return b.String()
+}
@@ -0,0 +1,129 @@
+//
+// prometheus metrics served on /metrics
+//
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/randomcoww/go-mpd-es/pkg/util"
+)
+
+const namespace = "mpd_es"
+
+var (
+	// MPD log lines parsed into index updates by add or delete
+	LogEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_events_total",
+		Help:      "MPD log events parsed by type.",
+	}, []string{"type"})
+
+	// MPD idle events by subsystem e.g. player, database
+	IdleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idle_events_total",
+		Help:      "MPD idle events by subsystem.",
+	}, []string{"subsystem"})
+
+	BulkBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_batch_actions",
+		Help:      "Actions per Elasticsearch bulk request.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	})
+
+	BulkDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_duration_seconds",
+		Help:      "Elasticsearch bulk request latency.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// request for whole requests that failed, item for actions given up on
+	// and retry for actions put back after ES rejected them
+	BulkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_failures_total",
+		Help:      "Elasticsearch bulk failures by kind.",
+	}, []string{"kind"})
+
+	WebSocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Connected WebSocket clients.",
+	})
+
+	WebSocketDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_dropped_messages_total",
+		Help:      "Broadcast messages dropped for WebSocket clients too slow to read them.",
+	})
+)
+
+// up state and reconnect count of a connection by backend name
+func RegisterConn(backend string, state func() util.ConnStatus) {
+	labels := prometheus.Labels{"backend": backend}
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "backend_up",
+		Help:        "Whether the connection to the backend is up.",
+		ConstLabels: labels,
+	}, func() float64 {
+		if state().Up {
+			return 1
+		}
+		return 0
+	})
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "backend_reconnects_total",
+		Help:        "Times the connection to the backend came back after going down.",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(state().Reconnects)
+	})
+}
+
+// gauge read from fn on each scrape e.g. queue lengths
+func RegisterGauge(name, help string, fn func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, func() float64 {
+		return float64(fn())
+	})
+}
+
+// events dropped by subscribers too slow to read them by topic
+// read from fn on each scrape
+func RegisterDropped(backend string, fn func() map[string]uint64) {
+	prometheus.MustRegister(&droppedCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "event_hub_dropped_total"),
+			"Connection events dropped for subscribers too slow to read them.",
+			[]string{"topic"},
+			prometheus.Labels{"backend": backend},
+		),
+		dropped: fn,
+	})
+}
+
+type droppedCollector struct {
+	desc    *prometheus.Desc
+	dropped func() map[string]uint64
+}
+
+func (c *droppedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *droppedCollector) Collect(ch chan<- prometheus.Metric) {
+	for topic, n := range c.dropped() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(n), topic)
+	}
+}
@@ -5,7 +5,9 @@
 package mpd
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
 
 	mpd "github.com/fhs/gompd/mpd"
@@ -13,153 +15,221 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// wait between failed metadata lookups
+const (
+	lookupMinBackoff = 500 * time.Millisecond
+	lookupMaxBackoff = 30 * time.Second
+)
+
 type MpdClient struct {
-	eventHub *util.EventHub
+	ctx        context.Context
+	supervisor *util.Supervisor
+
+	// commands wait here to be run one at a time
+	commands chan *command
 
-	Conn  *mpd.Client
-	proto string
-	addr  string
+	connLock sync.RWMutex
+	conn     *mpd.Client
+	proto    string
+	addr     string
 }
 
 // create new MPD client
-func NewMpdClient(proto, addr string) *MpdClient {
+// connects in the background and reconnects until ctx is done
+// commands wait for the connection up to their timeout
+func NewMpdClient(ctx context.Context, proto, addr string) *MpdClient {
 
 	logrus.Infof("MpdClient: Start")
 
 	c := &MpdClient{
-		eventHub: util.NewEventHub(),
+		ctx:      ctx,
+		commands: make(chan *command),
 		proto:    proto,
 		addr:     addr,
 	}
 
-	c.setReady()
-	go c.runRecovery()
+	c.supervisor = util.NewSupervisor("MpdClient", c.dial)
+	c.supervisor.Check = func(ctx context.Context) error {
+		return c.Exec(ctx, func(conn *Conn) error {
+			return conn.Ping()
+		})
+	}
+
+	go c.supervisor.Run(ctx)
+	go c.runCommands()
 
 	return c
 }
 
+// block until connected
+// returns ctx error if ctx is done first
+func (c *MpdClient) WaitReady(ctx context.Context) error {
+	return c.supervisor.WaitReady(ctx)
+}
+
 //
 // get connection
 //
 
-func (c *MpdClient) pingTest() bool {
-	err := c.Conn.Ping()
-	return err == nil
-}
-
-func (c *MpdClient) waitConnect() {
-	for {
-		select {
-		case <-time.After(1000 * time.Millisecond):
-			conn, err := mpd.Dial(c.proto, c.addr)
+func (c *MpdClient) dial(ctx context.Context) error {
+	conn, err := mpd.Dial(c.proto, c.addr)
+	if err != nil {
+		return err
+	}
 
-			if err == nil {
-				c.Conn = conn
+	c.connLock.Lock()
+	old := c.conn
+	c.conn = conn
+	c.connLock.Unlock()
 
-				logrus.Infof("MpdClient: Connection ready")
-				return
-			}
-		}
+	if old != nil {
+		old.Close()
 	}
+	return nil
 }
 
-func (c *MpdClient) waitPingState(state bool) {
-	for {
-		select {
-		case <-time.After(1000 * time.Millisecond):
-			if c.pingTest() == state {
-				logrus.Infof("MpdClient: Ping state changed: ", state)
-				return
-			}
-		}
+// current connection
+// only used by runCommands
+func (c *MpdClient) current() *mpd.Client {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
+	return c.conn
+}
+
+// close connection
+// call after ctx is done so it is not redialed
+func (c *MpdClient) Close() error {
+	conn := c.current()
+	if conn == nil {
+		return nil
 	}
+	return conn.Close()
 }
 
-func (c *MpdClient) setReady() {
-	c.waitConnect()
-	c.waitPingState(true)
-	c.eventHub.Send <- "api_ready"
+// connection state for health checks
+func (c *MpdClient) State() util.ConnStatus {
+	return c.supervisor.State()
 }
 
-func (c *MpdClient) setDown() {
-	c.waitPingState(false)
-	c.eventHub.Send <- "api_down"
+// connection events dropped by topic for metrics
+func (c *MpdClient) DroppedEvents() map[string]uint64 {
+	return c.supervisor.Events.Dropped()
 }
 
-func (c *MpdClient) runRecovery() {
-	errClient := c.eventHub.NewClient([]string{"api_down"})
-	readyClient := c.eventHub.NewClient([]string{"api_ready"})
+// lookup song metadata for elasticsearch index
+// retry with backoff until it works or ctx is done
+// lookups use their own connection so failures here don't take down the command connection
+func (c *MpdClient) GetDatabaseItem(mpdPath string) Tags {
+	backoff := lookupMinBackoff
 
 	for {
+		var item Tags
+		err := c.readEntries("lsinfo", mpdPath, func(t Tags) {
+			if _, ok := t["file"]; ok && item == nil {
+				item = t
+			}
+		})
+
+		switch err.(type) {
+		case nil:
+			return item
+		// MPD rejected the command e.g. file no longer exists
+		case *AckError:
+			return nil
+		}
+
+		logrus.Errorf("MpdClient: Lookup %s: %v: Retry in %v", mpdPath, err, backoff)
 		select {
-		case <-errClient.Events:
-			c.setReady()
-			errClient.Drain()
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return nil
+		}
 
-		case <-readyClient.Events:
-			c.setDown()
-			readyClient.Drain()
+		backoff *= 2
+		if backoff > lookupMaxBackoff {
+			backoff = lookupMaxBackoff
 		}
 	}
 }
 
-// lookup song metadata for elasticsearch index
-// loop with reconnect attempts to make sure this happens
-func (c *MpdClient) GetDatabaseItem(mpdPath string) map[string]string {
-	readyClient := c.eventHub.NewClient([]string{"api_ready"})
+// stream song metadata for all files under mpdPath
+// listallinfo is run per top level directory to keep responses under the MPD output buffer limit
+func (c *MpdClient) ListAllInfo(mpdPath string, fn func(Tags)) error {
+	var dirs []string
+
+	err := c.readEntries("lsinfo", mpdPath, func(t Tags) {
+		switch {
+		case t.Get("file") != "":
+			fn(t)
+		case t.Get("directory") != "":
+			dirs = append(dirs, t.Get("directory"))
+		}
+	})
+	if err != nil {
+		return err
+	}
 
-	for {
-		if attrs, err := c.Conn.ListInfo(mpdPath); err == nil {
-			if len(attrs) > 0 {
-				return attrs[0]
+	for _, dir := range dirs {
+		err := c.readEntries("listallinfo", dir, func(t Tags) {
+			if t.Get("file") != "" {
+				fn(t)
 			}
-			return nil
+		})
+		if err != nil {
+			return err
 		}
-
-		c.eventHub.Send <- "api_down"
-		readyClient.WaitEvent("api_ready")
 	}
-
 	return nil
 }
 
 // implement plchanges in same way as playlistinfo
 func (c *MpdClient) PlChanges(version, start, end int) ([]mpd.Attrs, error) {
-	var cmd *mpd.Command
-	switch {
-	case start < 0 && end < 0:
-		// Request all playlist items.
-		cmd = c.Conn.Command("plchanges %d", version)
-	case start >= 0 && end >= 0:
-		// Request this range of playlist items.
-		cmd = c.Conn.Command("plchanges %d %d:%d", version, start, end)
-	case start >= 0 && end < 0:
-		// Request the single playlist item at this position.
-		cmd = c.Conn.Command("plchanges %d %d", version, start)
-	case start < 0 && end >= 0:
-		return nil, errors.New("negative start index")
-	default:
-		panic("unreachable")
-	}
-	return cmd.AttrsList("file")
+	var attrs []mpd.Attrs
+	err := c.Run(func(conn *Conn) (err error) {
+		var cmd *mpd.Command
+		switch {
+		case start < 0 && end < 0:
+			// Request all playlist items.
+			cmd = conn.Command("plchanges %d", version)
+		case start >= 0 && end >= 0:
+			// Request this range of playlist items.
+			cmd = conn.Command("plchanges %d %d:%d", version, start, end)
+		case start >= 0 && end < 0:
+			// Request the single playlist item at this position.
+			cmd = conn.Command("plchanges %d %d", version, start)
+		case start < 0 && end >= 0:
+			return errors.New("negative start index")
+		default:
+			panic("unreachable")
+		}
+		attrs, err = cmd.AttrsList("file")
+		return err
+	})
+	return attrs, err
 }
 
 func (c *MpdClient) PlChangePosId(version, start, end int) ([]mpd.Attrs, error) {
-	var cmd *mpd.Command
-	switch {
-	case start < 0 && end < 0:
-		// Request all playlist items.
-		cmd = c.Conn.Command("plchangesposid %d", version)
-	case start >= 0 && end >= 0:
-		// Request this range of playlist items.
-		cmd = c.Conn.Command("plchangesposid %d %d:%d", version, start, end)
-	case start >= 0 && end < 0:
-		// Request the single playlist item at this position.
-		cmd = c.Conn.Command("plchangesposid %d %d", version, start)
-	case start < 0 && end >= 0:
-		return nil, errors.New("negative start index")
-	default:
-		panic("unreachable")
-	}
-	return cmd.AttrsList("cpos")
+	var attrs []mpd.Attrs
+	err := c.Run(func(conn *Conn) (err error) {
+		var cmd *mpd.Command
+		switch {
+		case start < 0 && end < 0:
+			// Request all playlist items.
+			cmd = conn.Command("plchangesposid %d", version)
+		case start >= 0 && end >= 0:
+			// Request this range of playlist items.
+			cmd = conn.Command("plchangesposid %d %d:%d", version, start, end)
+		case start >= 0 && end < 0:
+			// Request the single playlist item at this position.
+			cmd = conn.Command("plchangesposid %d %d", version, start)
+		case start < 0 && end >= 0:
+			return errors.New("negative start index")
+		default:
+			panic("unreachable")
+		}
+		attrs, err = cmd.AttrsList("cpos")
+		return err
+	})
+	return attrs, err
 }
@@ -5,7 +5,8 @@
 package mpd
 
 import (
-	"time"
+	"context"
+	"sync"
 
 	mpd "github.com/fhs/gompd/mpd"
 	"github.com/randomcoww/go-mpd-es/pkg/util"
@@ -13,30 +14,40 @@ import (
 )
 
 type MpdEvent struct {
-	eventHub *util.EventHub
-
-	conn  *mpd.Client
-	proto string
-	addr  string
+	ctx        context.Context
+	supervisor *util.Supervisor
+
+	// only used by the event listener
+	connLock sync.Mutex
+	conn     *mpd.Client
+	proto    string
+	addr     string
 	// Ready chan struct{}
 	Events chan string
 }
 
 // create new MPD client
-func NewMpdEvent(proto, addr string) *MpdEvent {
+// connects in the background and reconnects until ctx is done
+func NewMpdEvent(ctx context.Context, proto, addr string) *MpdEvent {
 
 	logrus.Infof("MpdEvent: Start")
 
 	c := &MpdEvent{
-		eventHub: util.NewEventHub(),
-		proto:    proto,
-		addr:     addr,
-		Events:   make(chan string),
+		ctx:    ctx,
+		proto:  proto,
+		addr:   addr,
+		Events: make(chan string),
 	}
 
-	c.setReady()
-	go c.runRecovery()
-	go c.runEventListener()
+	// idle blocks the connection so failures are found by the listener instead of a check
+	c.supervisor = util.NewSupervisor("MpdEvent", c.dial)
+
+	go c.supervisor.Run(ctx)
+	go func() {
+		if c.supervisor.WaitReady(ctx) == nil {
+			c.runEventListener()
+		}
+	}()
 
 	return c
 }
@@ -45,52 +56,74 @@ func NewMpdEvent(proto, addr string) *MpdEvent {
 // get connection
 //
 
-func (c *MpdEvent) setReady() {
-	c.waitConnect()
-	c.eventHub.Send <- "api_ready"
-}
-
-func (c *MpdEvent) waitConnect() {
-	for {
-		select {
-		case <-time.After(1000 * time.Millisecond):
-			conn, err := mpd.Dial(c.proto, c.addr)
+// new connection is picked up by the listener once it sees the old one fail
+func (c *MpdEvent) dial(ctx context.Context) error {
+	conn, err := mpd.Dial(c.proto, c.addr)
+	if err != nil {
+		return err
+	}
 
-			if err == nil {
-				c.conn = conn
+	c.connLock.Lock()
+	old := c.conn
+	c.conn = conn
+	c.connLock.Unlock()
 
-				logrus.Infof("MpdEvent: Connection ready")
-				return
-			}
-		}
+	if old != nil {
+		old.Close()
 	}
+	return nil
 }
 
-func (c *MpdEvent) runRecovery() {
-	errClient := c.eventHub.NewClient([]string{"api_ready"})
+// close connection ending the listener
+// call after ctx is done so it is not redialed
+func (c *MpdEvent) Close() error {
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
 
-	for {
-		select {
-		case <-errClient.Events:
-			c.setReady()
-			errClient.Drain()
-		}
+	if conn == nil {
+		return nil
 	}
+	return conn.Close()
 }
 
-func (c *MpdEvent) runEventListener() {
-	readyClient := c.eventHub.NewClient([]string{"api_ready"})
+// connection state for health checks
+func (c *MpdEvent) State() util.ConnStatus {
+	return c.supervisor.State()
+}
 
+// connection events dropped by topic for metrics
+func (c *MpdEvent) DroppedEvents() map[string]uint64 {
+	return c.supervisor.Events.Dropped()
+}
+
+func (c *MpdEvent) runEventListener() {
 	for {
-		changed, err := c.conn.Command("idle").Strings("changed")
+		c.connLock.Lock()
+		conn := c.conn
+		c.connLock.Unlock()
+
+		changed, err := conn.Command("idle").Strings("changed")
 		if err == nil {
 			for _, e := range changed {
-				logrus.Infof("MpdEvent: Event: ", e)
-				c.Events <- e
+				logrus.Infof("MpdEvent: Event: %s", e)
+				select {
+				case c.Events <- e:
+				case <-c.ctx.Done():
+					return
+				}
 			}
-		} else {
-			c.eventHub.Send <- "api_down"
-			readyClient.WaitEvent("api_ready")
+			continue
+		}
+
+		// closed on shutdown
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		c.supervisor.Down(err)
+		if c.supervisor.WaitReady(c.ctx) != nil {
+			return
 		}
 	}
 }
@@ -0,0 +1,108 @@
+//
+// run commands on the shared MPD connection one at a time
+// the gompd client can't be used by more than one goroutine at once
+//
+
+package mpd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mpd "github.com/fhs/gompd/mpd"
+	"github.com/sirupsen/logrus"
+)
+
+// connection passed to commands run by Run and Exec
+type Conn = mpd.Client
+
+// command responses
+type Attrs = mpd.Attrs
+
+// time a command may wait for earlier ones and run when the caller sets no deadline
+const commandTimeout = 10 * time.Second
+
+type command struct {
+	ctx  context.Context
+	fn   func(conn *Conn) error
+	done chan error
+}
+
+// run fn with the connection once earlier commands finish
+// gives up with ctx error if ctx is done first
+// ctx without a deadline gets the default timeout so a stuck command is always detected
+// conn must not be kept after fn returns
+func (c *MpdClient) Exec(ctx context.Context, fn func(conn *Conn) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, commandTimeout)
+		defer cancel()
+	}
+
+	cmd := &command{
+		ctx:  ctx,
+		fn:   fn,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case c.commands <- cmd:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+
+	return <-cmd.done
+}
+
+// Exec with the default timeout
+func (c *MpdClient) Run(fn func(conn *Conn) error) error {
+	return c.Exec(c.ctx, fn)
+}
+
+// run queued commands in order once connected until ctx is done
+// a command still running at its deadline is left on a connection that gets replaced
+// so its response can't be read by the next one
+func (c *MpdClient) runCommands() {
+	if c.supervisor.WaitReady(c.ctx) != nil {
+		return
+	}
+
+	for {
+		var cmd *command
+
+		select {
+		case cmd = <-c.commands:
+		case <-c.ctx.Done():
+			return
+		}
+
+		if err := cmd.ctx.Err(); err != nil {
+			cmd.done <- err
+			continue
+		}
+
+		conn := c.current()
+		result := make(chan error, 1)
+		go func() {
+			result <- cmd.fn(conn)
+		}()
+
+		select {
+		case err := <-result:
+			cmd.done <- err
+
+		case <-cmd.ctx.Done():
+			err := cmd.ctx.Err()
+			cmd.done <- err
+
+			logrus.Errorf("MpdClient: Command: %v", err)
+			c.supervisor.Down(fmt.Errorf("command did not finish: %v", err))
+			if c.supervisor.WaitReady(c.ctx) != nil {
+				return
+			}
+		}
+	}
+}
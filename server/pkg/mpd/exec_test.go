@@ -0,0 +1,104 @@
+package mpd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/randomcoww/go-mpd-es/pkg/util"
+)
+
+// client with a supervisor that always connects
+func newTestClient(ctx context.Context) *MpdClient {
+	c := &MpdClient{
+		ctx:      ctx,
+		commands: make(chan *command),
+	}
+	c.supervisor = util.NewSupervisor("Test", func(ctx context.Context) error {
+		return nil
+	})
+	c.supervisor.MinBackoff = time.Millisecond
+
+	go c.supervisor.Run(ctx)
+	c.supervisor.WaitReady(ctx)
+	go c.runCommands()
+
+	return c
+}
+
+func TestExecSerializes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newTestClient(ctx)
+
+	var (
+		lock    sync.Mutex
+		running int
+		overlap bool
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var got int
+			err := c.Run(func(conn *Conn) error {
+				lock.Lock()
+				running++
+				if running > 1 {
+					overlap = true
+				}
+				lock.Unlock()
+
+				time.Sleep(time.Millisecond)
+				got = i
+
+				lock.Lock()
+				running--
+				lock.Unlock()
+				return nil
+			})
+			if err != nil || got != i {
+				t.Errorf("command %d: got %d, %v", i, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if overlap {
+		t.Errorf("commands ran at the same time")
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newTestClient(ctx)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+
+	err := c.Exec(timeout, func(conn *Conn) error {
+		<-release
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+
+	// stuck command is left behind on a replaced connection
+	if err := c.Run(func(conn *Conn) error { return nil }); err != nil {
+		t.Fatalf("command after timeout: %v", err)
+	}
+	if s := c.State(); !s.Up || s.Reconnects != 1 {
+		t.Errorf("state = %+v, want up after 1 reconnect", s)
+	}
+}
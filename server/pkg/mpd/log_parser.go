@@ -0,0 +1,176 @@
+//
+// parse MPD log lines into typed events
+//
+
+package mpd
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+type LogLevel string
+
+// levels named after MPD log_level settings
+// log lines do not include the level so it is looked up from known messages
+const (
+	LogLevelUnknown LogLevel = "unknown"
+	LogLevelError   LogLevel = "error"
+	LogLevelWarning LogLevel = "warning"
+	LogLevelDefault LogLevel = "default"
+	LogLevelInfo    LogLevel = "info"
+	LogLevelVerbose LogLevel = "verbose"
+)
+
+type LogAction string
+
+const (
+	LogActionNone    LogAction = ""
+	LogActionAdded   LogAction = "added"
+	LogActionRemoved LogAction = "removed"
+)
+
+type LogEvent struct {
+	// zero if the line has no timestamp
+	Time      time.Time `json:"time"`
+	Component string    `json:"component,omitempty"`
+	Level     LogLevel  `json:"level"`
+	Message   string    `json:"message"`
+	Action    LogAction `json:"action,omitempty"`
+	Path      string    `json:"path,omitempty"`
+}
+
+// timestamp formats written by different MPD versions
+type logTimeFormat struct {
+	pattern *regexp.Regexp
+	layout  string
+	// format has no year and it is taken from the reference time
+	noYear bool
+}
+
+var (
+	logTimeFormats = []logTimeFormat{
+		// 0.21 and later with log_timestamp or journal style output
+		{regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?)(?: :)? `), "2006-01-02T15:04:05", false},
+		// syslog style with seconds
+		{regexp.MustCompile(`^([A-Z][a-z]{2} [ 0-9]\d \d{2}:\d{2}:\d{2})(?: :)? `), "Jan _2 15:04:05", true},
+		// default for 0.20 and earlier
+		{regexp.MustCompile(`^([A-Z][a-z]{2} [ 0-9]\d \d{2}:\d{2}) : `), "Jan _2 15:04", true},
+	}
+
+	// MPD log domain names
+	logComponentPattern = regexp.MustCompile(`^([a-z][a-z0-9_]*): `)
+
+	// level of known messages by component and message prefix
+	// first match wins so more specific prefixes go first
+	logLevels = []struct {
+		component string
+		prefix    string
+		level     LogLevel
+	}{
+		{"exception", "", LogLevelError},
+		{"update", "added ", LogLevelDefault},
+		{"update", "removing ", LogLevelDefault},
+		{"update", "updating ", LogLevelDefault},
+		{"update", "", LogLevelVerbose},
+		{"player", "played ", LogLevelDefault},
+		{"client", "", LogLevelInfo},
+		{"config", "", LogLevelVerbose},
+		{"db", "", LogLevelVerbose},
+		{"inotify", "", LogLevelVerbose},
+		{"output", "", LogLevelWarning},
+		{"decoder", "", LogLevelWarning},
+	}
+
+	logActions = []struct {
+		prefix string
+		action LogAction
+	}{
+		{"added ", LogActionAdded},
+		{"removing ", LogActionRemoved},
+	}
+)
+
+// parse a single line of MPD log
+// now is used for the year and location of timestamps - returns false for blank lines
+func ParseLogLine(line string, now time.Time) (LogEvent, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return LogEvent{}, false
+	}
+
+	e := LogEvent{
+		Level: LogLevelUnknown,
+	}
+
+	line = e.parseTime(line, now)
+
+	if m := logComponentPattern.FindStringSubmatch(line); m != nil {
+		e.Component = m[1]
+		line = line[len(m[0]):]
+	}
+	e.Message = line
+
+	e.parseLevel()
+	e.parseAction()
+
+	return e, true
+}
+
+// consume leading timestamp and return the rest of the line
+func (e *LogEvent) parseTime(line string, now time.Time) string {
+	for _, f := range logTimeFormats {
+		m := f.pattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		value := m[1]
+		if i := strings.Index(value, "."); i >= 0 {
+			value = value[:i]
+		}
+
+		t, err := time.ParseInLocation(f.layout, value, now.Location())
+		if err != nil {
+			continue
+		}
+
+		if f.noYear {
+			t = t.AddDate(now.Year(), 0, 0)
+			// logged last year if the date would be in the future
+			if t.After(now.AddDate(0, 0, 1)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+
+		e.Time = t
+		return line[len(m[0]):]
+	}
+	return line
+}
+
+func (e *LogEvent) parseLevel() {
+	for _, l := range logLevels {
+		if l.component == e.Component && strings.HasPrefix(e.Message, l.prefix) {
+			e.Level = l.level
+			return
+		}
+	}
+}
+
+// only the update component reports library changes
+// path is the rest of the message so paths containing log phrases are kept intact
+func (e *LogEvent) parseAction() {
+	if e.Component != "update" {
+		return
+	}
+
+	for _, a := range logActions {
+		if strings.HasPrefix(e.Message, a.prefix) {
+			e.Action = a.action
+			e.Path = e.Message[len(a.prefix):]
+			return
+		}
+	}
+}
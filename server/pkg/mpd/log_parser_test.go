@@ -0,0 +1,133 @@
+package mpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// reference time for timestamps without a year
+var parseTime = time.Date(2018, time.August, 2, 12, 0, 0, 0, time.UTC)
+
+// parse each testdata/*.log and compare with the matching .golden file
+// run with -update to regenerate golden files after reviewing parser changes
+func TestParseLogLineGolden(t *testing.T) {
+	logs, err := filepath.Glob(filepath.Join("testdata", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 {
+		t.Fatal("no log fixtures found")
+	}
+
+	for _, logPath := range logs {
+		name := strings.TrimSuffix(filepath.Base(logPath), ".log")
+
+		t.Run(name, func(t *testing.T) {
+			got := parseLogFile(t, logPath)
+			goldenPath := strings.TrimSuffix(logPath, ".log") + ".golden"
+
+			if *update {
+				if err := ioutil.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("parsed %s does not match %s\ngot:\n%s\nwant:\n%s", logPath, goldenPath, got, want)
+			}
+		})
+	}
+}
+
+// one JSON event per line
+func parseLogFile(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e, ok := ParseLogLine(scanner.Text(), parseTime)
+		if !ok {
+			continue
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestParseLogLineActions(t *testing.T) {
+	tests := []struct {
+		line   string
+		action LogAction
+		path   string
+	}{
+		{"Jan 05 10:11 : update: added a.mp3\n", LogActionAdded, "a.mp3"},
+		{"Jan 05 10:11 : update: removing a.mp3\n", LogActionRemoved, "a.mp3"},
+		{"Jan 05 10:11 : update: added update: removing b.mp3", LogActionAdded, "update: removing b.mp3"},
+		{"Jan 05 10:11 : player: played \"update: added c.mp3\"", LogActionNone, ""},
+		{"Jan 05 10:11 : update: scanning dir1", LogActionNone, ""},
+	}
+
+	for _, tt := range tests {
+		e, ok := ParseLogLine(tt.line, parseTime)
+		if !ok {
+			t.Errorf("%q: not parsed", tt.line)
+			continue
+		}
+		if e.Action != tt.action || e.Path != tt.path {
+			t.Errorf("%q: got action %q path %q, want %q %q", tt.line, e.Action, e.Path, tt.action, tt.path)
+		}
+	}
+}
+
+func TestParseLogLineYear(t *testing.T) {
+	// December lines read in early January were logged last year
+	now := time.Date(2019, time.January, 1, 0, 5, 0, 0, time.UTC)
+
+	e, _ := ParseLogLine("Dec 31 23:59 : update: starting", now)
+	if e.Time.Year() != 2018 {
+		t.Errorf("got year %d, want 2018", e.Time.Year())
+	}
+
+	e, _ = ParseLogLine("Jan 01 00:04 : update: starting", now)
+	if e.Time.Year() != 2019 {
+		t.Errorf("got year %d, want 2019", e.Time.Year())
+	}
+}
+
+func TestParseLogLineBlank(t *testing.T) {
+	for _, line := range []string{"", "\n", "  \r\n"} {
+		if _, ok := ParseLogLine(line, parseTime); ok {
+			t.Errorf("%q: parsed blank line", line)
+		}
+	}
+}
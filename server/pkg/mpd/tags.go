@@ -0,0 +1,142 @@
+//
+// read song metadata keeping every value of repeated tags
+// gompd Attrs keep only the last value of each key so multiple Artist or Genre lines are lost
+//
+
+package mpd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// song metadata by lower case tag name
+type Tags map[string][]string
+
+// keys that start a new entry in lsinfo and listallinfo responses
+var entryKeys = map[string]struct{}{
+	"file":      struct{}{},
+	"directory": struct{}{},
+	"playlist":  struct{}{},
+}
+
+// error response from MPD
+type AckError struct {
+	Message string
+}
+
+func (e *AckError) Error() string {
+	return e.Message
+}
+
+// create tags from single value attributes
+func NewTags(attrs map[string]string) Tags {
+	t := make(Tags)
+	for k, v := range attrs {
+		t.Add(k, v)
+	}
+	return t
+}
+
+func (t Tags) Add(key, value string) {
+	key = strings.ToLower(key)
+	t[key] = append(t[key], value)
+}
+
+// first value of tag
+func (t Tags) Get(key string) string {
+	if v := t[strings.ToLower(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// quote command argument
+func quoteArg(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// run command on a new connection and call fn for each file, directory or playlist entry
+// entries are passed on as they are read so large listings are not held in memory
+// gives up if MPD sends nothing for commandTimeout or ctx is done
+func (c *MpdClient) readEntries(command, arg string, fn func(Tags)) error {
+	dialer := &net.Dialer{Timeout: commandTimeout}
+	conn, err := dialer.DialContext(c.ctx, c.proto, c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// unblock reads on shutdown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	// greeting
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK MPD ") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s %s\n", command, quoteArg(arg)); err != nil {
+		return err
+	}
+
+	var entry Tags
+	for {
+		// long listings are fine as long as lines keep coming
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "OK":
+			if entry != nil {
+				fn(entry)
+			}
+			return nil
+
+		case strings.HasPrefix(line, "ACK "):
+			return &AckError{line}
+		}
+
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return fmt.Errorf("unexpected line: %s", line)
+		}
+		key, value := line[:i], line[i+2:]
+
+		if _, ok := entryKeys[strings.ToLower(key)]; ok {
+			if entry != nil {
+				fn(entry)
+			}
+			entry = make(Tags)
+		}
+
+		// lines before the first entry
+		if entry == nil {
+			continue
+		}
+		entry.Add(key, value)
+	}
+}
@@ -0,0 +1,256 @@
+//
+// field scoped query language for library search
+// e.g. artist:"miles davis" year:1955..1960 genre:jazz -live duration:>600
+//
+
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Kind int
+
+const (
+	// analyzed text matched by words
+	Text Kind = iota
+	// exact value
+	Keyword
+	// number allowing comparisons and ranges
+	Number
+	// yyyy, yyyy-MM or yyyy-MM-dd allowing comparisons and ranges
+	Date
+)
+
+// index field a query field name refers to
+type Field struct {
+	Name string
+	Kind Kind
+}
+
+// query field names allowed in field:value terms
+type Schema map[string]Field
+
+type Op string
+
+const (
+	OpEqual        Op = ""
+	OpGreater      Op = ">"
+	OpGreaterEqual Op = ">="
+	OpLess         Op = "<"
+	OpLessEqual    Op = "<="
+	// inclusive from..to with either end optional
+	OpRange Op = ".."
+)
+
+type Clause struct {
+	// nil for free text
+	Field  *Field
+	Op     Op
+	Value  string
+	To     string
+	Phrase bool
+	Negate bool
+}
+
+type Query struct {
+	Clauses []Clause
+}
+
+// error with position in the query string for clients to show
+type ParseError struct {
+	Pos     int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("query error at %d: %s", e.Pos+1, e.Message)
+}
+
+var (
+	fieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*:`)
+	datePattern  = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+)
+
+// parse query string using schema to resolve field names
+func Parse(input string, schema Schema) (*Query, error) {
+	p := &parser{
+		input:  input,
+		schema: schema,
+	}
+
+	q := &Query{}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return q, nil
+		}
+
+		c, err := p.clause()
+		if err != nil {
+			return nil, err
+		}
+		q.Clauses = append(q.Clauses, c)
+	}
+}
+
+// true if query has no terms
+func (q *Query) Empty() bool {
+	return q == nil || len(q.Clauses) == 0
+}
+
+type parser struct {
+	input  string
+	pos    int
+	schema Schema
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &ParseError{
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// [-][field:][op]value
+// a prefix that is not a field is part of a free text value e.g. Re:Zero
+func (p *parser) clause() (Clause, error) {
+	var c Clause
+	start := p.pos
+
+	if p.input[p.pos] == '-' {
+		c.Negate = true
+		p.pos++
+		if p.pos >= len(p.input) || isSpace(p.input[p.pos]) {
+			return c, p.errorf(start, "nothing to exclude after -")
+		}
+	}
+
+	var name string
+	if m := fieldPattern.FindString(p.input[p.pos:]); m != "" {
+		name = strings.ToLower(m[:len(m)-1])
+		if field, ok := p.schema[name]; ok {
+			c.Field = &field
+			p.pos += len(m)
+		}
+	}
+	if c.Field != nil {
+		if p.pos >= len(p.input) || isSpace(p.input[p.pos]) {
+			return c, p.errorf(p.pos, "missing value for %s", name)
+		}
+	}
+
+	valuePos := p.pos
+	value, quoted, err := p.value()
+	if err != nil {
+		return c, err
+	}
+
+	// quotes only group words for numbers and dates which are checked the same
+	if c.Field != nil && (c.Field.Kind == Number || c.Field.Kind == Date) {
+		if quoted {
+			valuePos++
+		}
+		return c, p.comparison(&c, name, value, valuePos)
+	}
+
+	c.Value = value
+	c.Phrase = quoted
+	return c, nil
+}
+
+// quoted phrase or run of non space characters
+func (p *parser) value() (string, bool, error) {
+	if p.input[p.pos] != '"' {
+		start := p.pos
+		for p.pos < len(p.input) && !isSpace(p.input[p.pos]) {
+			p.pos++
+		}
+		return p.input[start:p.pos], false, nil
+	}
+
+	start := p.pos
+	p.pos++
+
+	var b strings.Builder
+	for p.pos < len(p.input) {
+		ch := p.input[p.pos]
+		switch {
+		case ch == '\\' && p.pos+1 < len(p.input):
+			b.WriteByte(p.input[p.pos+1])
+			p.pos += 2
+		case ch == '"':
+			p.pos++
+			if b.Len() == 0 {
+				return "", true, p.errorf(start, "empty quotes")
+			}
+			return b.String(), true, nil
+		default:
+			b.WriteByte(ch)
+			p.pos++
+		}
+	}
+	return "", true, p.errorf(start, "missing closing quote")
+}
+
+// >v, >=v, <v, <=v, from..to or v
+func (p *parser) comparison(c *Clause, name, value string, pos int) error {
+	for _, op := range []Op{OpGreaterEqual, OpLessEqual, OpGreater, OpLess} {
+		if strings.HasPrefix(value, string(op)) {
+			c.Op = op
+			c.Value = value[len(op):]
+			return p.checkValue(c.Field.Kind, name, c.Value, pos+len(op))
+		}
+	}
+
+	if i := strings.Index(value, string(OpRange)); i >= 0 {
+		c.Op = OpRange
+		c.Value = value[:i]
+		c.To = value[i+len(OpRange):]
+
+		if c.Value == "" && c.To == "" {
+			return p.errorf(pos, "range needs at least one end")
+		}
+		if c.Value != "" {
+			if err := p.checkValue(c.Field.Kind, name, c.Value, pos); err != nil {
+				return err
+			}
+		}
+		if c.To != "" {
+			if err := p.checkValue(c.Field.Kind, name, c.To, pos+i+len(OpRange)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c.Value = value
+	return p.checkValue(c.Field.Kind, name, value, pos)
+}
+
+func (p *parser) checkValue(kind Kind, name, value string, pos int) error {
+	switch kind {
+	case Number:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return p.errorf(pos, "%s needs a number, got %q", name, value)
+		}
+	case Date:
+		if !datePattern.MatchString(value) {
+			return p.errorf(pos, "%s needs a date as yyyy, yyyy-mm or yyyy-mm-dd, got %q", name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testSchema = Schema{
+	"artist":   {Name: "artist", Kind: Text},
+	"genre":    {Name: "genre", Kind: Text},
+	"format":   {Name: "format", Kind: Keyword},
+	"year":     {Name: "year", Kind: Number},
+	"duration": {Name: "duration", Kind: Number},
+	"date":     {Name: "date", Kind: Date},
+}
+
+func field(name string) *Field {
+	f := testSchema[name]
+	return &f
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []Clause
+	}{
+		{"", nil},
+		{"  blue  train ", []Clause{
+			{Value: "blue"},
+			{Value: "train"},
+		}},
+		{`artist:"miles davis" year:1955..1960 genre:jazz -live duration:>600`, []Clause{
+			{Field: field("artist"), Value: "miles davis", Phrase: true},
+			{Field: field("year"), Op: OpRange, Value: "1955", To: "1960"},
+			{Field: field("genre"), Value: "jazz"},
+			{Value: "live", Negate: true},
+			{Field: field("duration"), Op: OpGreater, Value: "600"},
+		}},
+		{`-"live at" YEAR:<=1970 date:2001-09.. format:flac`, []Clause{
+			{Value: "live at", Phrase: true, Negate: true},
+			{Field: field("year"), Op: OpLessEqual, Value: "1970"},
+			{Field: field("date"), Op: OpRange, Value: "2001-09"},
+			{Field: field("format"), Value: "flac"},
+		}},
+		{`"say \"hi\"" ac/dc`, []Clause{
+			{Value: `say "hi"`, Phrase: true},
+			{Value: "ac/dc"},
+		}},
+		// quoted numbers and dates are checked as if unquoted
+		{`year:"1959" date:">=1959-08"`, []Clause{
+			{Field: field("year"), Value: "1959"},
+			{Field: field("date"), Op: OpGreaterEqual, Value: "1959-08"},
+		}},
+		// prefixes that are not fields are free text
+		{`Re:Zero -artst:miles Op. 2: Allegro`, []Clause{
+			{Value: "Re:Zero"},
+			{Value: "artst:miles", Negate: true},
+			{Value: "Op."},
+			{Value: "2:"},
+			{Value: "Allegro"},
+		}},
+	}
+
+	for _, tt := range tests {
+		q, err := Parse(tt.input, testSchema)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Clauses, tt.want) {
+			t.Errorf("Parse(%q):\ngot  %+v\nwant %+v", tt.input, q.Clauses, tt.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input   string
+		pos     int
+		message string
+	}{
+		{`jazz artist:`, 12, "missing value for artist"},
+		{`artist:"miles`, 7, "missing closing quote"},
+		{`jazz - live`, 5, "nothing to exclude"},
+		{`year:195x`, 5, "year needs a number"},
+		{`year:1955..abc`, 11, "year needs a number"},
+		{`year:..`, 5, "range needs at least one end"},
+		{`date:>1959/01`, 6, "date needs a date"},
+		{`""`, 0, "empty quotes"},
+		{`date:"abc"`, 6, "date needs a date"},
+		{`year:"x"`, 6, "year needs a number"},
+		{`year:"1955..x"`, 12, "year needs a number"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.input, testSchema)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Parse(%q): got %v, want ParseError", tt.input, err)
+			continue
+		}
+		if perr.Pos != tt.pos || !strings.Contains(perr.Message, tt.message) {
+			t.Errorf("Parse(%q): got %d %q, want %d %q", tt.input, perr.Pos, perr.Message, tt.pos, tt.message)
+		}
+	}
+}
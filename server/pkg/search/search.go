@@ -0,0 +1,137 @@
+//
+// search backend interfaces shared by the indexer and the API
+// implemented by elasticsearch and the embedded index
+//
+
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+)
+
+// receives index updates from the log reader and reconciler
+// updates may be batched and applied later
+type Indexer interface {
+	IndexBulk(id string, doc interface{})
+	DeleteBluk(id string)
+	// call fn with the id of every indexed document
+	ScrollIds(fn func(id string)) error
+}
+
+// indexer that builds a new index in the background on mapping change
+type Rebuilder interface {
+	// index waiting to be filled, empty if none
+	PendingIndex() string
+	IndexBulkTo(index, id string, doc interface{})
+	// switch searches to the pending index
+	SwapAlias() error
+}
+
+// indexer keeping updates the backend rejected to apply later
+type Replayer interface {
+	// updates waiting to be replayed
+	DeadLetters() int
+	// queue waiting updates again returning how many
+	ReplayDeadLetters() (int, error)
+}
+
+// backend holding updates to write before exit
+type Closer interface {
+	// write pending updates giving up when ctx is done
+	Close(ctx context.Context) error
+}
+
+// queries from the API
+// field names are index fields with an optional sub field e.g. artist.keyword
+type Searcher interface {
+	// indexed document or nil if not found
+	Get(id string) (*json.RawMessage, error)
+	Search(q *query.Query, filters map[string][]string, cursor string, start, size int) (*Result, error)
+	Export(q *query.Query, filters map[string][]string, fn func(Hit) error) error
+	Facets(q *query.Query, fields map[string]string, filters map[string][]string, size int) (map[string][]FacetBucket, error)
+	Suggest(text string, fields []SuggestField, size int) ([]Suggestion, error)
+}
+
+type Backend interface {
+	Indexer
+	Searcher
+}
+
+type Hit struct {
+	Id    string  `json:"id"`
+	Score float64 `json:"score"`
+	// indexed document
+	Song *json.RawMessage `json:"song"`
+	// matched text fragments by field with matches wrapped in <em>
+	Highlight map[string][]string `json:"highlight,omitempty"`
+}
+
+type Result struct {
+	Hits  []Hit `json:"hits"`
+	Start int   `json:"start"`
+	// total matching documents and time the search took
+	Total int64 `json:"total"`
+	Took  int64 `json:"took"`
+	// pass to the next search to continue after the last hit
+	// empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type FacetBucket struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+type SuggestField struct {
+	// suggestion type returned to clients e.g. artist
+	Type string
+	// edge ngram field matched against typed text
+	Match string
+	// keyword field suggestion values are read from
+	Value string
+}
+
+type Suggestion struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+const (
+	HighlightPreTag  = "<em>"
+	HighlightPostTag = "</em>"
+
+	// fragments per field and characters per fragment
+	HighlightFragments    = 3
+	HighlightFragmentSize = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sort values of the last hit on a page encoded for clients to pass back
+func EncodeCursor(sort []interface{}) string {
+	b, err := json.Marshal(sort)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sort values from cursor expecting n of them
+func DecodeCursor(cursor string, n int) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var sort []interface{}
+	if err := json.Unmarshal(b, &sort); err != nil || len(sort) != n {
+		return nil, ErrInvalidCursor
+	}
+	return sort, nil
+}
@@ -0,0 +1,214 @@
+//
+// songs and cases shared by the tests of each embedded search backend
+//
+
+package searchtest
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+)
+
+type Song struct {
+	File     string   `json:"file"`
+	Title    string   `json:"title,omitempty"`
+	Artist   []string `json:"artist,omitempty"`
+	Album    string   `json:"album,omitempty"`
+	Genre    []string `json:"genre,omitempty"`
+	Composer []string `json:"composer,omitempty"`
+	Year     int      `json:"year,omitempty"`
+	Date     string   `json:"date,omitempty"`
+	Duration float64  `json:"duration,omitempty"`
+}
+
+var Songs = []Song{
+	{File: "a.flac", Title: "So What", Artist: []string{"Miles Davis"}, Album: "Kind of Blue", Genre: []string{"Jazz"}, Year: 1959, Date: "1959-08-17", Duration: 562},
+	{File: "b.flac", Title: "Blue in Green", Artist: []string{"Miles Davis"}, Album: "Kind of Blue", Genre: []string{"Jazz"}, Composer: []string{"Bill Evans"}, Year: 1959, Date: "1959", Duration: 337},
+	{File: "c.flac", Title: "Walkin' (Live)", Artist: []string{"Miles Davis"}, Album: "Live at Newport", Genre: []string{"Jazz"}, Year: 1958, Duration: 820},
+	{File: "d.flac", Title: "Blue Train", Artist: []string{"John Coltrane"}, Album: "Blue Train", Genre: []string{"Jazz"}, Year: 1957, Duration: 643},
+	{File: "e.flac", Title: "Café Müller", Artist: []string{"Björk"}, Album: "Débût", Genre: []string{"Pop"}, Year: 1993},
+	{File: "f.flac", Title: "東京の空", Artist: []string{"坂本龍一"}, Album: "東京", Year: 1980},
+}
+
+var SearchFields = []string{"title", "artist", "album", "genre", "composer"}
+
+var Schema = query.Schema{
+	"title":    {Name: "title", Kind: query.Text},
+	"artist":   {Name: "artist", Kind: query.Text},
+	"genre":    {Name: "genre", Kind: query.Text},
+	"composer": {Name: "composer", Kind: query.Text},
+	"year":     {Name: "year", Kind: query.Number},
+	"duration": {Name: "duration", Kind: query.Number},
+	"date":     {Name: "date", Kind: query.Date},
+	"file":     {Name: "file", Kind: query.Keyword},
+}
+
+// search behavior a backend may not have
+type Feature string
+
+const (
+	// words matched within a couple of edits
+	Fuzzy Feature = "typo tolerance"
+	// free text words all matched in one field
+	SameField Feature = "all words in one field"
+	// CJK text split into words
+	CJKWords Feature = "CJK word splitting"
+)
+
+type Case struct {
+	Query   string
+	Filters map[string][]string
+	Want    []string
+	// skipped for backends without it
+	Needs Feature
+}
+
+var Cases = []Case{
+	{Query: "", Want: []string{"a.flac", "b.flac", "c.flac", "d.flac", "e.flac", "f.flac"}},
+	{Query: "kind blue", Want: []string{"a.flac", "b.flac"}},
+	{Query: "coltrain", Want: []string{"d.flac"}, Needs: Fuzzy},
+	// accents
+	{Query: "cafe muller", Want: []string{"e.flac"}},
+	{Query: "bjork debut", Want: []string{}, Needs: SameField},
+	{Query: "東京", Want: []string{"f.flac"}},
+	{Query: "title:東京", Want: []string{"f.flac"}, Needs: CJKWords},
+	{Query: `"blue train"`, Want: []string{"d.flac"}},
+	{Query: `artist:"miles davis" year:1955..1960 genre:jazz -live duration:>300`, Want: []string{"a.flac", "b.flac"}},
+	{Query: "year:<1958", Want: []string{"d.flac"}},
+	{Query: "date:1959", Want: []string{"a.flac", "b.flac"}},
+	{Query: "date:>1959-08", Want: []string{}},
+	{Query: "composer:evans", Want: []string{"b.flac"}},
+	{Query: "-artist:davis -東京", Want: []string{"d.flac", "e.flac"}},
+	{Query: "-artist:davis -東京の空", Want: []string{"d.flac", "e.flac"}},
+	{Query: "file:c.flac", Want: []string{"c.flac"}},
+	{Query: "blue", Filters: map[string][]string{"artist.keyword": {"John Coltrane"}}, Want: []string{"d.flac"}},
+	{Query: "", Filters: map[string][]string{"year": {"1959", "1993"}}, Want: []string{"a.flac", "b.flac", "e.flac"}},
+}
+
+// run the shared tests against indexes with Songs written by newIndex
+// cases needing an unsupported feature are skipped
+func Run(t *testing.T, newIndex func(t *testing.T) search.Searcher, unsupported ...Feature) {
+	t.Run("Search", func(t *testing.T) {
+		testSearch(t, newIndex(t), unsupported)
+	})
+	t.Run("SearchPaging", func(t *testing.T) {
+		testSearchPaging(t, newIndex(t))
+	})
+	t.Run("Highlight", func(t *testing.T) {
+		testHighlight(t, newIndex(t))
+	})
+	t.Run("FacetsAndSuggest", func(t *testing.T) {
+		testFacetsAndSuggest(t, newIndex(t))
+	})
+}
+
+// sorted ids of all hits
+func SearchIds(t *testing.T, c search.Searcher, text string, filters map[string][]string) []string {
+	q, err := query.Parse(text, Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Search(q, filters, "", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, h := range r.Hits {
+		ids = append(ids, h.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func testSearch(t *testing.T, c search.Searcher, unsupported []Feature) {
+	for _, tt := range Cases {
+		t.Run(tt.Query, func(t *testing.T) {
+			for _, f := range unsupported {
+				if tt.Needs == f {
+					t.Skipf("unsupported: %s", f)
+				}
+			}
+
+			if got := SearchIds(t, c, tt.Query, tt.Filters); !reflect.DeepEqual(got, tt.Want) {
+				t.Errorf("Search(%q, %v) = %v, want %v", tt.Query, tt.Filters, got, tt.Want)
+			}
+		})
+	}
+}
+
+func testSearchPaging(t *testing.T, c search.Searcher) {
+	var ids []string
+	cursor := ""
+	for page := 0; ; page++ {
+		r, err := c.Search(nil, nil, cursor, page*2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Total != int64(len(Songs)) {
+			t.Errorf("Total = %d, want %d", r.Total, len(Songs))
+		}
+		for _, h := range r.Hits {
+			ids = append(ids, h.Id)
+		}
+		if r.Cursor == "" {
+			break
+		}
+		cursor = r.Cursor
+	}
+
+	want := []string{"a.flac", "b.flac", "c.flac", "d.flac", "e.flac", "f.flac"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("paged ids = %v, want %v", ids, want)
+	}
+
+	if _, err := c.Search(nil, nil, "bad", 0, 2); err != search.ErrInvalidCursor {
+		t.Errorf("bad cursor: got %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testHighlight(t *testing.T, c search.Searcher) {
+	q, _ := query.Parse("evans", Schema)
+	r, err := c.Search(q, nil, "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(r.Hits))
+	}
+
+	want := map[string][]string{"composer": {"Bill <em>Evans</em>"}}
+	if got := r.Hits[0].Highlight; !reflect.DeepEqual(got, want) {
+		t.Errorf("Highlight = %v, want %v", got, want)
+	}
+}
+
+func testFacetsAndSuggest(t *testing.T, c search.Searcher) {
+	q, _ := query.Parse("genre:jazz", Schema)
+	facets, err := c.Facets(q, map[string]string{"artist": "artist.keyword"}, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFacets := []search.FacetBucket{{Value: "Miles Davis", Count: 3}, {Value: "John Coltrane", Count: 1}}
+	if !reflect.DeepEqual(facets["artist"], wantFacets) {
+		t.Errorf("Facets = %v, want %v", facets["artist"], wantFacets)
+	}
+
+	suggestions, err := c.Suggest("mil da", []search.SuggestField{
+		{Type: "artist", Match: "artist.suggest", Value: "artist.keyword"},
+	}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSuggestions := []search.Suggestion{{Type: "artist", Value: "Miles Davis", Count: 3}}
+	if !reflect.DeepEqual(suggestions, wantSuggestions) {
+		t.Errorf("Suggest = %v, want %v", suggestions, wantSuggestions)
+	}
+}
@@ -0,0 +1,542 @@
+//
+// song catalog in a local SQLite database with an FTS5 full text index
+// needs building with -tags sqlite_fts5
+//
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/sirupsen/logrus"
+)
+
+var _ search.Backend = (*Index)(nil)
+var _ search.Closer = (*Index)(nil)
+
+type Index struct {
+	db           *sql.DB
+	searchFields []string
+
+	// updates waiting for the next transaction
+	lock    sync.Mutex
+	pending []update
+	flush   chan struct{}
+
+	// one transaction at a time keeps updates in order
+	flushLock sync.Mutex
+	// closed by Close to stop runFlush and closed by runFlush once stopped
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type update struct {
+	id string
+	// nil for delete
+	doc json.RawMessage
+	// failed transactions while first in a batch
+	attempts int
+}
+
+const (
+	// updates per transaction and the longest they wait
+	batchSize     = 1000
+	flushInterval = 2 * time.Second
+
+	// failed transactions before a batch is split to find the updates the database won't take
+	flushRetries = 5
+
+	// separates values of multi valued fields in the full text index
+	valueSeparator = "\x1f"
+)
+
+var datePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// open or create database at path with search fields full text indexed
+// the full text index is rebuilt if search fields changed
+func New(path string, searchFields []string) (*Index, error) {
+	logrus.Infof("SQLite: Start")
+
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Index{
+		db:           db,
+		searchFields: searchFields,
+		flush:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	if err := c.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go c.runFlush()
+	return c, nil
+}
+
+func (c *Index) createTables() error {
+	_, err := c.db.Exec(`
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS songs (
+	id TEXT PRIMARY KEY,
+	doc TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS song_values (
+	id TEXT NOT NULL,
+	field TEXT NOT NULL,
+	value TEXT NOT NULL,
+	-- set for numbers
+	num REAL,
+	-- yyyy-mm-dd of partial dates
+	date TEXT
+);
+CREATE INDEX IF NOT EXISTS song_values_field ON song_values (field, value);
+CREATE INDEX IF NOT EXISTS song_values_id ON song_values (id);`)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Join(c.searchFields, ",")
+
+	var current string
+	err = c.db.QueryRow(`SELECT value FROM settings WHERE key = 'search_fields'`).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && current == fields {
+		return nil
+	}
+
+	return c.rebuildFts(fields)
+}
+
+// create full text table with a column per search field and fill it from stored songs
+func (c *Index) rebuildFts(fields string) error {
+	logrus.Infof("SQLite: Rebuild full text index: %s", fields)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	columns := make([]string, len(c.searchFields))
+	for i, f := range c.searchFields {
+		columns[i] = quoteIdent(f)
+	}
+
+	// folds case and accents like the elasticsearch mapping
+	_, err = tx.Exec(fmt.Sprintf(`
+DROP TABLE IF EXISTS songs_fts;
+CREATE VIRTUAL TABLE songs_fts USING fts5(%s, tokenize = 'unicode61 remove_diacritics 2');`,
+		strings.Join(columns, ", ")))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT rowid, doc FROM songs`)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		rowid int64
+		doc   []byte
+	}
+	var songs []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.rowid, &r.doc); err != nil {
+			rows.Close()
+			return err
+		}
+		songs = append(songs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range songs {
+		values, err := flatten(r.doc)
+		if err != nil {
+			logrus.Errorf("SQLite: Skip bad document %d: %v", r.rowid, err)
+			continue
+		}
+		if err := c.insertFts(tx, r.rowid, values); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES ('search_fields', ?)`, fields)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//
+// Update index
+//
+
+// add document to next transaction
+func (c *Index) IndexBulk(id string, s interface{}) {
+	doc, err := json.Marshal(s)
+	if err != nil {
+		logrus.Errorf("SQLite: Index %s: Failed: %v", id, err)
+		return
+	}
+	c.queue(update{id: id, doc: doc})
+}
+
+// add deletion to next transaction
+func (c *Index) DeleteBluk(id string) {
+	c.queue(update{id: id})
+}
+
+func (c *Index) queue(u update) {
+	c.lock.Lock()
+	c.pending = append(c.pending, u)
+	full := len(c.pending) >= batchSize
+	c.lock.Unlock()
+
+	if full {
+		select {
+		case c.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush when full or on interval until Close
+func (c *Index) runFlush() {
+	defer close(c.stopped)
+
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-c.flush:
+		case <-tick.C:
+		case <-c.done:
+			return
+		}
+
+		if err := c.Flush(); err != nil {
+			logrus.Errorf("SQLite: Bulk update: Failed: %v", err)
+		}
+	}
+}
+
+// write queued updates in one transaction
+// updates are put back for the next flush if the transaction fails
+func (c *Index) Flush() error {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+
+	c.lock.Lock()
+	updates := c.pending
+	c.pending = nil
+	c.lock.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	retry, err := c.writeBatch(updates)
+	if len(retry) > 0 {
+		c.lock.Lock()
+		c.pending = append(retry, c.pending...)
+		c.lock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("SQLite: Bulk update: Success: %d", len(updates))
+	return nil
+}
+
+// write updates returning the ones to put back
+// retried as is while the database is busy or full
+// other errors are retried up to flushRetries times then the batch is split
+// until the updates the database won't take are found and dropped on their own
+func (c *Index) writeBatch(updates []update) ([]update, error) {
+	err := c.write(updates)
+	if err == nil {
+		return nil, nil
+	}
+
+	if e, ok := err.(sqlite3.Error); ok {
+		switch e.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrFull:
+			return updates, err
+		}
+	}
+
+	updates[0].attempts++
+	if updates[0].attempts < flushRetries {
+		return updates, err
+	}
+
+	if len(updates) == 1 {
+		logrus.Errorf("SQLite: Update %s: Dropped: %v", updates[0].id, err)
+		return nil, nil
+	}
+
+	logrus.Errorf("SQLite: Bulk update: Split %d updates", len(updates))
+
+	half := len(updates) / 2
+	first, second := updates[:half], updates[half:]
+	for _, batch := range [][]update{first, second} {
+		batch[0].attempts = flushRetries - 1
+	}
+
+	retry, err := c.writeBatch(first)
+	if err != nil {
+		return append(retry, second...), err
+	}
+	return c.writeBatch(second)
+}
+
+func (c *Index) write(updates []update) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		if err := c.delete(tx, u.id); err != nil {
+			return err
+		}
+		if u.doc == nil {
+			continue
+		}
+		if err := c.insert(tx, u.id, u.doc); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *Index) delete(tx *sql.Tx, id string) error {
+	var rowid int64
+	err := tx.QueryRow(`SELECT rowid FROM songs WHERE id = ?`, id).Scan(&rowid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM songs_fts WHERE rowid = ?`, rowid); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM song_values WHERE id = ?`, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM songs WHERE rowid = ?`, rowid)
+	return err
+}
+
+func (c *Index) insert(tx *sql.Tx, id string, doc json.RawMessage) error {
+	values, err := flatten(doc)
+	if err != nil {
+		logrus.Errorf("SQLite: Index %s: Failed: %v", id, err)
+		return nil
+	}
+
+	res, err := tx.Exec(`INSERT INTO songs (id, doc) VALUES (?, ?)`, id, string(doc))
+	if err != nil {
+		return err
+	}
+	rowid, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for field, vs := range values {
+		for _, v := range vs {
+			var (
+				value string
+				num   interface{}
+				date  interface{}
+			)
+
+			switch v := v.(type) {
+			case float64:
+				value = strconv.FormatFloat(v, 'f', -1, 64)
+				num = v
+			case bool:
+				value = strconv.FormatBool(v)
+			case string:
+				value = v
+				if datePattern.MatchString(v) {
+					date = firstDay(v)
+				}
+			}
+
+			_, err := tx.Exec(`INSERT INTO song_values (id, field, value, num, date) VALUES (?, ?, ?, ?, ?)`,
+				id, field, value, num, date)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.insertFts(tx, rowid, values)
+}
+
+func (c *Index) insertFts(tx *sql.Tx, rowid int64, values map[string][]interface{}) error {
+	columns := make([]string, len(c.searchFields))
+	args := []interface{}{rowid}
+
+	for i, f := range c.searchFields {
+		columns[i] = quoteIdent(f)
+
+		var text []string
+		for _, v := range values[f] {
+			if s, ok := v.(string); ok {
+				text = append(text, s)
+			}
+		}
+		args = append(args, strings.Join(text, valueSeparator))
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(`INSERT INTO songs_fts (rowid, %s) VALUES (?%s)`,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns))), args...)
+	return err
+}
+
+// call fn with the id of every document in the index
+func (c *Index) ScrollIds(fn func(id string)) error {
+	rows, err := c.db.Query(`SELECT id FROM songs`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		fn(id)
+	}
+	return nil
+}
+
+// indexed document or nil if not found
+func (c *Index) Get(id string) (*json.RawMessage, error) {
+	var doc string
+	err := c.db.QueryRow(`SELECT doc FROM songs WHERE id = ?`, id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	source := json.RawMessage(doc)
+	return &source, nil
+}
+
+// stop flushing on interval, write pending updates and close database
+// local writes are not cut short by ctx
+func (c *Index) Close(ctx context.Context) error {
+	close(c.done)
+	<-c.stopped
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.db.Close()
+}
+
+//
+// helpers
+//
+
+// top level values of a document by field
+// nested objects are not indexed
+func flatten(doc []byte) (map[string][]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]interface{})
+	for field, v := range fields {
+		var vs []interface{}
+		switch v := v.(type) {
+		case []interface{}:
+			vs = v
+		default:
+			vs = []interface{}{v}
+		}
+
+		for _, value := range vs {
+			switch value.(type) {
+			case string, float64, bool:
+				values[field] = append(values[field], value)
+			}
+		}
+	}
+	return values, nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func firstDay(date string) string {
+	switch len(date) {
+	case len("yyyy"):
+		return date + "-01-01"
+	case len("yyyy-MM"):
+		return date + "-01"
+	}
+	return date
+}
+
+// day numbers past the end of the month are fine for string comparison
+func lastDay(date string) string {
+	switch len(date) {
+	case len("yyyy"):
+		return date + "-12-31"
+	case len("yyyy-MM"):
+		return date + "-31"
+	}
+	return date
+}
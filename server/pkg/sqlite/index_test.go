@@ -0,0 +1,260 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+	"github.com/randomcoww/go-mpd-es/pkg/search/searchtest"
+)
+
+func newTestIndex(t *testing.T, path string) *Index {
+	if path == "" {
+		dir, err := ioutil.TempDir("", "sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		path = filepath.Join(dir, "songs.db")
+	}
+
+	c, err := New(path, searchtest.SearchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range searchtest.Songs {
+		c.IndexBulk(s.File, s)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// FTS5 matches whole tokens across columns
+var unsupported = []searchtest.Feature{searchtest.Fuzzy, searchtest.SameField, searchtest.CJKWords}
+
+func TestSearch(t *testing.T) {
+	searchtest.Run(t, func(t *testing.T) search.Searcher {
+		c := newTestIndex(t, "")
+		t.Cleanup(func() { c.Close(context.Background()) })
+		return c
+	}, unsupported...)
+}
+
+// written songs are searched the same after reopening
+func TestSearchReopened(t *testing.T) {
+	searchtest.Run(t, func(t *testing.T) search.Searcher {
+		dir, err := ioutil.TempDir("", "sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		path := filepath.Join(dir, "songs.db")
+
+		if err := newTestIndex(t, path).Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := New(path, searchtest.SearchFields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close(context.Background()) })
+		return c
+	}, unsupported...)
+}
+
+func TestBatch(t *testing.T) {
+	c := newTestIndex(t, "")
+	defer c.db.Close()
+
+	// stop runFlush in place of Close so only a full batch signals a flush
+	close(c.done)
+	<-c.stopped
+
+	c.DeleteBluk("a.flac")
+	for i := 1; i < batchSize-1; i++ {
+		c.IndexBulk("g.flac", searchtest.Song{File: "g.flac", Title: fmt.Sprintf("Naima %d", i)})
+	}
+
+	// queued updates are not written until flushed
+	if source, err := c.Get("a.flac"); err != nil || source == nil {
+		t.Fatalf("a.flac before flush = %v, %v", source, err)
+	}
+	if len(c.flush) != 0 {
+		t.Fatal("flush signaled before batch is full")
+	}
+
+	c.IndexBulk("g.flac", searchtest.Song{File: "g.flac", Title: "Naima"})
+	if len(c.flush) != 1 {
+		t.Fatal("flush not signaled for full batch")
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if source, err := c.Get("a.flac"); err != nil || source != nil {
+		t.Errorf("a.flac after flush = %s, %v", source, err)
+	}
+
+	source, err := c.Get("g.flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var song searchtest.Song
+	if err := json.Unmarshal(*source, &song); err != nil {
+		t.Fatal(err)
+	}
+	if song.Title != "Naima" {
+		t.Errorf("title after flush = %q, want last update", song.Title)
+	}
+}
+
+func TestFlushRetry(t *testing.T) {
+	c := newTestIndex(t, "")
+	defer c.Close(context.Background())
+
+	c.DeleteBluk("a.flac")
+	c.IndexBulk("g.flac", searchtest.Song{File: "g.flac", Title: "Naima"})
+
+	// transaction fails
+	if _, err := c.db.Exec(`ALTER TABLE songs RENAME TO songs_moved`); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err == nil {
+		t.Fatal("Flush succeeded without songs table")
+	}
+	if n := len(c.pending); n != 2 {
+		t.Fatalf("pending after failed flush = %d, want 2", n)
+	}
+
+	// updates queued after the failure apply after the ones put back
+	c.IndexBulk("g.flac", searchtest.Song{File: "g.flac", Title: "Naima (Live)"})
+
+	if _, err := c.db.Exec(`ALTER TABLE songs_moved RENAME TO songs`); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	c.ScrollIds(func(id string) {
+		ids = append(ids, id)
+	})
+	sort.Strings(ids)
+
+	if want := []string{"b.flac", "c.flac", "d.flac", "e.flac", "f.flac", "g.flac"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids after retry = %v, want %v", ids, want)
+	}
+
+	if got := searchtest.SearchIds(t, c, "live", nil); !reflect.DeepEqual(got, []string{"c.flac", "g.flac"}) {
+		t.Errorf("search after retry = %v", got)
+	}
+}
+
+func TestFlushDropsRejected(t *testing.T) {
+	c := newTestIndex(t, "")
+	defer c.Close(context.Background())
+
+	// one update the database always rejects
+	_, err := c.db.Exec(`CREATE TRIGGER reject BEFORE INSERT ON songs WHEN NEW.id = 'bad.flac'
+BEGIN SELECT RAISE(ABORT, 'rejected'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.DeleteBluk("a.flac")
+	c.IndexBulk("bad.flac", searchtest.Song{File: "bad.flac"})
+	c.IndexBulk("g.flac", searchtest.Song{File: "g.flac", Title: "Naima"})
+
+	for i := 1; i < flushRetries; i++ {
+		if err := c.Flush(); err == nil {
+			t.Fatalf("Flush %d succeeded with rejected update", i)
+		}
+		if n := len(c.pending); n != 3 {
+			t.Fatalf("pending after failed flush %d = %d, want 3", i, n)
+		}
+	}
+
+	// out of retries the batch is split and the rejected update dropped
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.pending); n != 0 {
+		t.Errorf("pending after split = %d, want 0", n)
+	}
+
+	var ids []string
+	c.ScrollIds(func(id string) {
+		ids = append(ids, id)
+	})
+	sort.Strings(ids)
+
+	if want := []string{"b.flac", "c.flac", "d.flac", "e.flac", "f.flac", "g.flac"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids after split = %v, want %v", ids, want)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "songs.db")
+
+	c := newTestIndex(t, path)
+	c.DeleteBluk("f.flac")
+	c.IndexBulk("a.flac", searchtest.Song{File: "a.flac", Title: "So What (Remastered)"})
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// changed search fields rebuild the full text index
+	reopened, err := New(path, []string{"title", "artist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+
+	var ids []string
+	reopened.ScrollIds(func(id string) {
+		ids = append(ids, id)
+	})
+	sort.Strings(ids)
+
+	if want := []string{"a.flac", "b.flac", "c.flac", "d.flac", "e.flac"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("reopened ids = %v, want %v", ids, want)
+	}
+
+	source, err := reopened.Get("a.flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var song searchtest.Song
+	if err := json.Unmarshal(*source, &song); err != nil {
+		t.Fatal(err)
+	}
+	if song.Title != "So What (Remastered)" {
+		t.Errorf("reopened title = %q", song.Title)
+	}
+
+	if got := searchtest.SearchIds(t, reopened, "remastered", nil); !reflect.DeepEqual(got, []string{"a.flac"}) {
+		t.Errorf("search after reopen = %v", got)
+	}
+}
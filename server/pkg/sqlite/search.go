@@ -0,0 +1,486 @@
+//
+// queries against the SQLite index
+// text terms go to the FTS5 table and field terms to stored values
+//
+
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randomcoww/go-mpd-es/pkg/query"
+	"github.com/randomcoww/go-mpd-es/pkg/search"
+)
+
+// result size if none is given
+const defaultSize = 10
+
+// SQL for a parsed query
+type sqlQuery struct {
+	// full text expressions all documents must match
+	match []string
+	conds []string
+	args  []interface{}
+}
+
+func (q *sqlQuery) where(cond string, args ...interface{}) {
+	q.conds = append(q.conds, cond)
+	q.args = append(q.args, args...)
+}
+
+// songs joined with the full text table if ranked by text matches
+func (q *sqlQuery) from() string {
+	if len(q.match) > 0 {
+		return `songs s JOIN songs_fts ON songs_fts.rowid = s.rowid`
+	}
+	return `songs s`
+}
+
+func (q *sqlQuery) score() string {
+	if len(q.match) > 0 {
+		// bm25 is lower for better matches
+		return `-bm25(songs_fts)`
+	}
+	return `1.0`
+}
+
+func (q *sqlQuery) whereSQL() (string, []interface{}) {
+	conds := q.conds
+	args := q.args
+	if len(q.match) > 0 {
+		conds = append([]string{`songs_fts MATCH ?`}, conds...)
+		args = append([]interface{}{strings.Join(q.match, " AND ")}, args...)
+	}
+
+	if len(conds) == 0 {
+		return `1`, args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// search with scores and highlighted matches
+// pages continue from cursor if set and from start otherwise
+func (c *Index) Search(q *query.Query, filters map[string][]string, cursor string, start, size int) (*search.Result, error) {
+	begin := time.Now()
+
+	if size < 0 {
+		size = defaultSize
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	sq := c.buildQuery(q, filters)
+	where, args := sq.whereSQL()
+
+	r := &search.Result{
+		Hits:  []search.Hit{},
+		Start: start,
+	}
+
+	err := c.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, sq.from(), where), args...).
+		Scan(&r.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	var highlights []string
+	if len(sq.match) > 0 {
+		for i := range c.searchFields {
+			highlights = append(highlights, fmt.Sprintf(`, highlight(songs_fts, %d, '%s', '%s')`,
+				i, search.HighlightPreTag, search.HighlightPostTag))
+		}
+	}
+
+	// page after cursor or at offset
+	after := `1`
+	offset := start
+	if cursor != "" {
+		sort, err := search.DecodeCursor(cursor, 2)
+		if err != nil {
+			return nil, err
+		}
+		score, ok1 := sort[0].(float64)
+		id, ok2 := sort[1].(string)
+		if !ok1 || !ok2 {
+			return nil, search.ErrInvalidCursor
+		}
+
+		after = `(score < ? OR (score = ? AND id > ?))`
+		args = append(args, score, score, id)
+		offset = 0
+	}
+	args = append(args, size, offset)
+
+	rows, err := c.db.Query(fmt.Sprintf(`
+SELECT * FROM (
+	SELECT s.id AS id, s.doc AS doc, %s AS score%s
+	FROM %s WHERE %s
+) WHERE %s
+ORDER BY score DESC, id
+LIMIT ? OFFSET ?`, sq.score(), strings.Join(highlights, ""), sq.from(), where, after), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			h     search.Hit
+			doc   string
+			texts = make([]sql.NullString, len(highlights))
+		)
+
+		dest := []interface{}{&h.Id, &doc, &h.Score}
+		for i := range texts {
+			dest = append(dest, &texts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		source := json.RawMessage(doc)
+		h.Song = &source
+		h.Highlight = c.highlight(texts)
+
+		r.Hits = append(r.Hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if n := len(r.Hits); n > 0 && n == size {
+		last := r.Hits[n-1]
+		if more, err := c.hasMore(sq, last); err != nil {
+			return nil, err
+		} else if more {
+			r.Cursor = search.EncodeCursor([]interface{}{last.Score, last.Id})
+		}
+	}
+
+	r.Took = int64(time.Since(begin) / time.Millisecond)
+	return r, nil
+}
+
+// true if results continue after hit
+func (c *Index) hasMore(sq *sqlQuery, last search.Hit) (bool, error) {
+	where, args := sq.whereSQL()
+	args = append(args, last.Score, last.Score, last.Id)
+
+	var more bool
+	err := c.db.QueryRow(fmt.Sprintf(`
+SELECT EXISTS (
+	SELECT 1 FROM (
+		SELECT s.id AS id, %s AS score FROM %s WHERE %s
+	) WHERE score < ? OR (score = ? AND id > ?)
+)`, sq.score(), sq.from(), where), args...).Scan(&more)
+	return more, err
+}
+
+// matched values of each search field
+func (c *Index) highlight(texts []sql.NullString) map[string][]string {
+	var highlight map[string][]string
+
+	for i, text := range texts {
+		if !text.Valid || !strings.Contains(text.String, search.HighlightPreTag) {
+			continue
+		}
+
+		field := c.searchFields[i]
+		for _, value := range strings.Split(text.String, valueSeparator) {
+			if !strings.Contains(value, search.HighlightPreTag) {
+				continue
+			}
+			if len(highlight[field]) >= search.HighlightFragments {
+				break
+			}
+
+			if highlight == nil {
+				highlight = make(map[string][]string)
+			}
+			highlight[field] = append(highlight[field], value)
+		}
+	}
+
+	return highlight
+}
+
+// call fn for every search result in order without highlights
+func (c *Index) Export(q *query.Query, filters map[string][]string, fn func(search.Hit) error) error {
+	sq := c.buildQuery(q, filters)
+	where, args := sq.whereSQL()
+
+	rows, err := c.db.Query(fmt.Sprintf(`
+SELECT s.id, s.doc, %s AS score FROM %s WHERE %s
+ORDER BY score DESC, s.id`, sq.score(), sq.from(), where), args...)
+	if err != nil {
+		return err
+	}
+
+	// read all first so fn can take its time without holding the query open
+	var hits []search.Hit
+	for rows.Next() {
+		var (
+			h   search.Hit
+			doc string
+		)
+		if err := rows.Scan(&h.Id, &doc, &h.Score); err != nil {
+			rows.Close()
+			return err
+		}
+
+		source := json.RawMessage(doc)
+		h.Song = &source
+		hits = append(hits, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range hits {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count documents per value of each facet
+// fields maps facet names to keyword or numeric fields
+// filters holds values already chosen per facet and narrows all counts
+func (c *Index) Facets(q *query.Query, fields map[string]string, filters map[string][]string, size int) (map[string][]search.FacetBucket, error) {
+	fieldFilters := make(map[string][]string)
+	for name, values := range filters {
+		if field, ok := fields[name]; ok {
+			fieldFilters[field] = values
+		}
+	}
+
+	sq := c.buildQuery(q, fieldFilters)
+	where, args := sq.whereSQL()
+
+	facets := make(map[string][]search.FacetBucket)
+	for name, field := range fields {
+		buckets, err := c.countValues(baseField(field), sq.from(), where, args, size)
+		if err != nil {
+			return nil, err
+		}
+		facets[name] = buckets
+	}
+	return facets, nil
+}
+
+// distinct values of each field starting with the typed words
+func (c *Index) Suggest(text string, fields []search.SuggestField, size int) ([]search.Suggestion, error) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	prefixes := make([]string, len(words))
+	for i, w := range words {
+		prefixes[i] = ftsString(w) + "*"
+	}
+
+	var suggestions []search.Suggestion
+	for _, f := range fields {
+		match := baseField(f.Match)
+		if !c.isSearchField(match) {
+			continue
+		}
+
+		buckets, err := c.countValues(baseField(f.Value),
+			`songs s JOIN songs_fts ON songs_fts.rowid = s.rowid`,
+			`songs_fts MATCH ?`,
+			[]interface{}{fmt.Sprintf(`%s : (%s)`, match, strings.Join(prefixes, " AND "))},
+			size)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range buckets {
+			value, ok := b.Value.(string)
+			if !ok {
+				continue
+			}
+
+			suggestions = append(suggestions, search.Suggestion{
+				Type:  f.Type,
+				Value: value,
+				Count: b.Count,
+			})
+		}
+	}
+
+	return suggestions, nil
+}
+
+// documents per value of field by count then value
+func (c *Index) countValues(field, from, where string, args []interface{}, size int) ([]search.FacetBucket, error) {
+	args = append([]interface{}{field}, args...)
+	args = append(args, size)
+
+	rows, err := c.db.Query(fmt.Sprintf(`
+SELECT v.value, MAX(v.num), COUNT(DISTINCT v.id) AS n
+FROM song_values v
+WHERE v.field = ? AND v.id IN (SELECT s.id FROM %s WHERE %s)
+GROUP BY v.value
+ORDER BY n DESC, v.value
+LIMIT ?`, from, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []search.FacetBucket{}
+	for rows.Next() {
+		var (
+			b     search.FacetBucket
+			value string
+			num   sql.NullFloat64
+		)
+		if err := rows.Scan(&value, &num, &b.Count); err != nil {
+			return nil, err
+		}
+
+		if num.Valid {
+			b.Value = num.Float64
+		} else {
+			b.Value = value
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+//
+// query building
+//
+
+func (c *Index) buildQuery(q *query.Query, filters map[string][]string) *sqlQuery {
+	sq := &sqlQuery{}
+
+	for field, values := range filters {
+		if len(values) == 0 {
+			continue
+		}
+
+		args := []interface{}{baseField(field)}
+		for _, v := range values {
+			args = append(args, v)
+		}
+		sq.where(fmt.Sprintf(`EXISTS (SELECT 1 FROM song_values v WHERE v.id = s.id AND v.field = ? AND v.value IN (?%s))`,
+			strings.Repeat(", ?", len(values)-1)), args...)
+	}
+
+	if q.Empty() {
+		return sq
+	}
+
+	for _, clause := range q.Clauses {
+		// full text
+		if clause.Field == nil || (clause.Field.Kind == query.Text && c.isSearchField(clause.Field.Name)) {
+			expr := ftsString(clause.Value)
+			if clause.Field != nil {
+				expr = clause.Field.Name + " : " + expr
+			}
+
+			if clause.Negate {
+				sq.where(`s.rowid NOT IN (SELECT rowid FROM songs_fts WHERE songs_fts MATCH ?)`, expr)
+			} else {
+				sq.match = append(sq.match, expr)
+			}
+			continue
+		}
+
+		cond, args := valueCond(clause)
+
+		exists := `EXISTS`
+		if clause.Negate {
+			exists = `NOT EXISTS`
+		}
+		sq.where(fmt.Sprintf(`%s (SELECT 1 FROM song_values v WHERE v.id = s.id AND v.field = ? AND %s)`, exists, cond),
+			append([]interface{}{clause.Field.Name}, args...)...)
+	}
+
+	return sq
+}
+
+// condition on song_values v for a field term
+func valueCond(clause query.Clause) (string, []interface{}) {
+	column := `v.value`
+	value, to := interface{}(clause.Value), interface{}(clause.To)
+
+	switch clause.Field.Kind {
+	case query.Number:
+		column = `v.num`
+		value, _ = strconv.ParseFloat(clause.Value, 64)
+		to, _ = strconv.ParseFloat(clause.To, 64)
+	case query.Date:
+		column = `v.date`
+	case query.Text:
+		return `v.value = ? COLLATE NOCASE`, []interface{}{clause.Value}
+	case query.Keyword:
+		return `v.value = ?`, []interface{}{clause.Value}
+	}
+
+	// partial dates cover their whole year or month
+	from, through := value, to
+	if clause.Field.Kind == query.Date {
+		from, through = firstDay(clause.Value), lastDay(clause.Value)
+		to = lastDay(clause.To)
+	}
+
+	switch clause.Op {
+	case query.OpGreater:
+		return column + ` > ?`, []interface{}{through}
+	case query.OpGreaterEqual:
+		return column + ` >= ?`, []interface{}{from}
+	case query.OpLess:
+		return column + ` < ?`, []interface{}{from}
+	case query.OpLessEqual:
+		return column + ` <= ?`, []interface{}{through}
+	case query.OpRange:
+		switch {
+		case clause.Value == "":
+			return column + ` <= ?`, []interface{}{to}
+		case clause.To == "":
+			return column + ` >= ?`, []interface{}{from}
+		}
+		return column + ` BETWEEN ? AND ?`, []interface{}{from, to}
+	}
+
+	if clause.Field.Kind == query.Date {
+		return column + ` BETWEEN ? AND ?`, []interface{}{from, through}
+	}
+	return column + ` = ?`, []interface{}{value}
+}
+
+func (c *Index) isSearchField(field string) bool {
+	for _, f := range c.searchFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// FTS5 string so query text is never read as syntax
+func ftsString(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// field name without sub field
+// sub fields like keyword and suggest map to the same values here
+func baseField(field string) string {
+	if i := strings.Index(field, "."); i >= 0 {
+		return field[:i]
+	}
+	return field
+}
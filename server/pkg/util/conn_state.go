@@ -0,0 +1,59 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// connection state following api/ready and api/down transitions
+type ConnState struct {
+	lock      sync.Mutex
+	status    ConnStatus
+	connected bool
+}
+
+type ConnStatus struct {
+	Up bool `json:"up"`
+	// time of the last change between up and down
+	Changed time.Time `json:"changed"`
+	// last error that took the connection down
+	Error string `json:"error,omitempty"`
+	// times the connection came back after going down
+	Reconnects int64 `json:"reconnects"`
+}
+
+func (s *ConnState) Ready() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.status.Up {
+		return
+	}
+	if s.connected {
+		s.status.Reconnects++
+	}
+	s.connected = true
+	s.status.Up = true
+	s.status.Changed = time.Now()
+}
+
+func (s *ConnState) Down(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+	if !s.status.Up {
+		return
+	}
+	s.status.Up = false
+	s.status.Changed = time.Now()
+}
+
+func (s *ConnState) Status() ConnStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.status
+}
@@ -1,87 +1,286 @@
 package util
 
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// what happens to events for a subscriber that falls behind
+type Delivery int
+
+const (
+	// drop events arriving while the buffer is full
+	DropNewest Delivery = iota
+	// make room by dropping the oldest buffered event
+	DropOldest
+	// wait up to Timeout for room then drop
+	Block
+	// keep only the latest event
+	Coalesce
+)
+
+type Policy struct {
+	Delivery Delivery
+	// events held for the subscriber, 1 for Coalesce
+	Buffer  int
+	Timeout time.Duration
+}
+
+var (
+	// drop newest past 16 events
+	DefaultPolicy = Policy{
+		Delivery: DropNewest,
+		Buffer:   16,
+	}
+
+	// state changes where only the latest matters e.g. api/ready
+	StatePolicy = Policy{
+		Delivery: Coalesce,
+	}
+)
+
+// connection state changes published by backend clients
+const (
+	TopicApiReady = "api/ready"
+	TopicApiDown  = "api/down"
+)
+
+type Event struct {
+	// levels separated by / e.g. api/ready
+	Topic   string
+	Payload interface{}
+	Time    time.Time
+}
+
+// publish events to subscribers matching their topic
 type EventHub struct {
-	Send       chan string
-	Register   chan *EventClient
-	Unregister chan *EventClient
-	Clients    map[*EventClient]struct{}
+	lock          sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+
+	// events dropped by topic across all subscriptions including ended ones
+	droppedLock sync.Mutex
+	dropped     map[string]uint64
 }
 
-type EventClient struct {
-	Events chan string
-	Filter map[string]struct{}
+type Subscription struct {
+	Events <-chan Event
+
+	hub      *EventHub
+	policy   Policy
+	patterns []string
+	done     <-chan struct{}
+
+	// held while sending so events is not closed under a publisher
+	lock   sync.Mutex
+	events chan Event
+	closed bool
+
+	dropped atomic.Uint64
 }
 
 func NewEventHub() *EventHub {
-	e := &EventHub{
-		Send:       make(chan string),
-		Register:   make(chan *EventClient),
-		Unregister: make(chan *EventClient),
-		Clients:    make(map[*EventClient]struct{}),
+	return &EventHub{
+		subscriptions: make(map[*Subscription]struct{}),
+		dropped:       make(map[string]uint64),
+	}
+}
+
+// subscribe to topics matching any of patterns until ctx is done
+// a level of a pattern is matched as with path.Match and a last level of # matches any remaining levels
+// e.g. api/* matches api/ready and api/down, # matches everything
+// Events is closed when the subscription ends
+func (e *EventHub) Subscribe(ctx context.Context, patterns ...string) *Subscription {
+	return e.SubscribeWith(ctx, DefaultPolicy, patterns...)
+}
+
+// subscribe with policy for events arriving faster than they are read
+func (e *EventHub) SubscribeWith(ctx context.Context, policy Policy, patterns ...string) *Subscription {
+	if policy.Delivery == Coalesce || policy.Buffer < 1 {
+		policy.Buffer = 1
 	}
-	go e.run()
-	return e
+	events := make(chan Event, policy.Buffer)
+
+	s := &Subscription{
+		Events:   events,
+		hub:      e,
+		policy:   policy,
+		patterns: patterns,
+		done:     ctx.Done(),
+		events:   events,
+	}
+
+	e.lock.Lock()
+	e.subscriptions[s] = struct{}{}
+	e.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		e.lock.Lock()
+		delete(e.subscriptions, s)
+		e.lock.Unlock()
+
+		s.lock.Lock()
+		s.closed = true
+		close(s.events)
+		s.lock.Unlock()
+
+		// coalescing drops stale state by design
+		if n := s.Dropped(); n > 0 && policy.Delivery != Coalesce {
+			logrus.Infof("EventHub: Subscription %v fell behind: Dropped %d events", patterns, n)
+		}
+	}()
+
+	return s
 }
 
-func (e *EventHub) NewClient(filter []string) *EventClient {
-	c := &EventClient{
-		Events: make(chan string),
-		Filter: make(map[string]struct{}),
+// send event to matching subscribers as their policies allow
+// returns after every subscriber has the event or dropped it
+func (e *EventHub) Publish(topic string, payload interface{}) {
+	event := Event{
+		Topic:   topic,
+		Payload: payload,
+		Time:    time.Now(),
 	}
-	for _, e := range filter {
-		if e != "" {
-			c.Filter[e] = struct{}{}
+
+	e.lock.RLock()
+	var subscriptions []*Subscription
+	for s := range e.subscriptions {
+		if s.match(topic) {
+			subscriptions = append(subscriptions, s)
 		}
 	}
-	e.Register <- c
-	return c
+	e.lock.RUnlock()
+
+	for _, s := range subscriptions {
+		s.deliver(event)
+	}
 }
 
-func (e *EventHub) run() {
-	for {
+func (s *Subscription) deliver(event Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+
+	switch s.policy.Delivery {
+	case Block:
+		timer := time.NewTimer(s.policy.Timeout)
+		defer timer.Stop()
+
 		select {
-		// Add new client
-		case c := <-e.Register:
-			e.Clients[c] = struct{}{}
-			// Remove client
-		case c := <-e.Unregister:
-			if _, ok := e.Clients[c]; ok {
-				close(c.Events)
-				delete(e.Clients, c)
-			}
-			// Send to all clients
-		case event := <-e.Send:
-			for c, _ := range e.Clients {
-				if _, ok := c.Filter[event]; ok {
-					select {
-					case c.Events <- event:
-					default:
-						// close(c.Events)
-						// delete(e.Clients, c)
-					}
-				}
-			}
+		case s.events <- event:
+			return
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+
+	case DropOldest, Coalesce:
+		// the subscriber may read the oldest first leaving room anyway
+		select {
+		case old := <-s.events:
+			s.drop(old.Topic)
+		default:
+		}
+		select {
+		case s.events <- event:
+			return
+		default:
 		}
 	}
+
+	s.drop(event.Topic)
 }
 
-func (c *EventClient) WaitEvent(eventMatch string) {
-	for {
-		select {
-		case event := <-c.Events:
-			if event == eventMatch {
-				return
-			}
+func (s *Subscription) drop(topic string) {
+	s.dropped.Add(1)
+
+	s.hub.droppedLock.Lock()
+	s.hub.dropped[topic]++
+	s.hub.droppedLock.Unlock()
+}
+
+// events dropped because the subscriber fell behind
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// events dropped by topic for metrics
+func (e *EventHub) Dropped() map[string]uint64 {
+	e.droppedLock.Lock()
+	defer e.droppedLock.Unlock()
+
+	dropped := make(map[string]uint64, len(e.dropped))
+	for topic, n := range e.dropped {
+		dropped[topic] = n
+	}
+	return dropped
+}
+
+func (s *Subscription) match(topic string) bool {
+	for _, p := range s.patterns {
+		if MatchTopic(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// block until an event with topic is received
+// returns false if the subscription ended first
+func (s *Subscription) WaitEvent(topic string) (Event, bool) {
+	for event := range s.Events {
+		if MatchTopic(topic, event.Topic) {
+			return event, true
 		}
 	}
+	return Event{}, false
 }
 
-func (c *EventClient) Drain() {
+// discard events already received
+func (s *Subscription) Drain() {
 	for {
 		select {
-		case <-c.Events:
+		case _, ok := <-s.Events:
+			if !ok {
+				return
+			}
 		default:
 			return
 		}
 	}
 }
+
+// true if topic matches pattern
+func MatchTopic(pattern, topic string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, p := range patternLevels {
+		if p == "#" && i == len(patternLevels)-1 {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if ok, err := path.Match(p, topicLevels[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"api/ready", "api/ready", true},
+		{"api/ready", "api/down", false},
+		{"api/*", "api/down", true},
+		{"api/*", "api", false},
+		{"api/*", "api/down/es", false},
+		{"api/#", "api", true},
+		{"api/#", "api/down/es", true},
+		{"#", "api/ready", true},
+		{"*/ready", "api/ready", true},
+		{"api_*", "api_ready", true},
+		{"api", "api/ready", false},
+	}
+
+	for _, test := range tests {
+		if got := MatchTopic(test.pattern, test.topic); got != test.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", test.pattern, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	hub := NewEventHub()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all := hub.Subscribe(ctx, "api/*")
+	ready := hub.Subscribe(context.Background(), TopicApiReady)
+
+	hub.Publish(TopicApiDown, "refused")
+	hub.Publish(TopicApiReady, nil)
+
+	e := <-all.Events
+	if e.Topic != TopicApiDown || e.Payload != "refused" || e.Time.IsZero() {
+		t.Errorf("got %+v", e)
+	}
+	if e, ok := all.WaitEvent(TopicApiReady); !ok || e.Topic != TopicApiReady {
+		t.Errorf("WaitEvent = %+v, %v", e, ok)
+	}
+	if e := <-ready.Events; e.Topic != TopicApiReady {
+		t.Errorf("got %+v", e)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-all.Events:
+		if ok {
+			t.Errorf("event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("events not closed after cancel")
+	}
+	if _, ok := all.WaitEvent(TopicApiReady); ok {
+		t.Errorf("WaitEvent after cancel returned an event")
+	}
+
+	hub.lock.RLock()
+	n := len(hub.subscriptions)
+	hub.lock.RUnlock()
+	if n != 1 {
+		t.Errorf("%d subscriptions after cancel, want 1", n)
+	}
+
+	// publishing to a full subscription drops instead of blocking
+	for i := 0; i < DefaultPolicy.Buffer*2; i++ {
+		hub.Publish(TopicApiReady, i)
+	}
+	if d := ready.Dropped(); d != uint64(DefaultPolicy.Buffer) {
+		t.Errorf("dropped %d, want %d", d, DefaultPolicy.Buffer)
+	}
+	if d := hub.Dropped()[TopicApiReady]; d != uint64(DefaultPolicy.Buffer) {
+		t.Errorf("hub dropped %d, want %d", d, DefaultPolicy.Buffer)
+	}
+	ready.Drain()
+}
+
+func TestDeliveryPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		want    []int
+		dropped uint64
+	}{
+		{"drop newest", Policy{Delivery: DropNewest, Buffer: 2}, []int{0, 1}, 3},
+		{"drop oldest", Policy{Delivery: DropOldest, Buffer: 2}, []int{3, 4}, 3},
+		{"coalesce", Policy{Delivery: Coalesce, Buffer: 5}, []int{4}, 4},
+		{"block", Policy{Delivery: Block, Buffer: 2, Timeout: time.Millisecond}, []int{0, 1}, 3},
+	}
+
+	for _, test := range tests {
+		hub := NewEventHub()
+		s := hub.SubscribeWith(context.Background(), test.policy, "#")
+
+		for i := 0; i < 5; i++ {
+			hub.Publish("n", i)
+		}
+
+		var got []int
+		for len(s.Events) > 0 {
+			got = append(got, (<-s.Events).Payload.(int))
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+		if d := s.Dropped(); d != test.dropped {
+			t.Errorf("%s: dropped %d, want %d", test.name, d, test.dropped)
+		}
+	}
+}
+
+func TestBlockDelivery(t *testing.T) {
+	hub := NewEventHub()
+	s := hub.SubscribeWith(context.Background(), Policy{Delivery: Block, Buffer: 1, Timeout: time.Second}, "#")
+
+	hub.Publish("n", 0)
+
+	// second publish waits for the reader
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-s.Events
+	}()
+	hub.Publish("n", 1)
+
+	if e := <-s.Events; e.Payload != 1 {
+		t.Errorf("got %+v, want 1", e)
+	}
+	if d := s.Dropped(); d != 0 {
+		t.Errorf("dropped %d, want 0", d)
+	}
+}
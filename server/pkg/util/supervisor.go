@@ -0,0 +1,172 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// keeps a connection up
+// redials with exponential backoff and jitter after it goes down and checks it while up
+type Supervisor struct {
+	// name for logs e.g. MpdClient
+	Name string
+
+	// make a new connection current
+	Dial func(ctx context.Context) error
+	// nil while the current connection works
+	// connections without a check are only taken down by Down
+	Check func(ctx context.Context) error
+	// called after each change with the error taking the connection down
+	OnChange func(up bool, err error)
+
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	CheckInterval time.Duration
+
+	// api/ready and api/down
+	Events *EventHub
+
+	state ConnState
+	down  chan error
+}
+
+func NewSupervisor(name string, dial func(ctx context.Context) error) *Supervisor {
+	return &Supervisor{
+		Name:          name,
+		Dial:          dial,
+		MinBackoff:    500 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		CheckInterval: 5 * time.Second,
+		Events:        NewEventHub(),
+		down:          make(chan error, 1),
+	}
+}
+
+// keep connection up until ctx is done
+func (s *Supervisor) Run(ctx context.Context) {
+	for {
+		if !s.connect(ctx) {
+			return
+		}
+
+		err, ok := s.watch(ctx)
+		if !ok {
+			return
+		}
+
+		logrus.Errorf("%s: Connection down: %v", s.Name, err)
+		s.state.Down(err)
+		s.Events.Publish(TopicApiDown, err)
+		if s.OnChange != nil {
+			s.OnChange(false, err)
+		}
+	}
+}
+
+// dial until it works
+// returns false if ctx is done first
+func (s *Supervisor) connect(ctx context.Context) bool {
+	backoff := s.MinBackoff
+
+	for {
+		err := s.Dial(ctx)
+		if err == nil {
+			break
+		}
+		s.state.Down(err)
+
+		wait := jitter(backoff)
+		logrus.Errorf("%s: Connect failed: %v: Retry in %v", s.Name, err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return false
+		}
+
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+
+	// failures reported against the old connection
+	select {
+	case <-s.down:
+	default:
+	}
+
+	logrus.Infof("%s: Connection ready", s.Name)
+	s.state.Ready()
+	s.Events.Publish(TopicApiReady, nil)
+	if s.OnChange != nil {
+		s.OnChange(true, nil)
+	}
+	return true
+}
+
+// wait for the connection to fail
+// returns false if ctx is done first
+func (s *Supervisor) watch(ctx context.Context) (error, bool) {
+	var check <-chan time.Time
+	if s.Check != nil {
+		tick := time.NewTicker(s.CheckInterval)
+		defer tick.Stop()
+		check = tick.C
+	}
+
+	for {
+		select {
+		case err := <-s.down:
+			return err, true
+
+		case <-check:
+			if err := s.Check(ctx); err != nil {
+				return err, true
+			}
+
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// report the current connection failed so it is replaced
+func (s *Supervisor) Down(err error) {
+	s.state.Down(err)
+
+	select {
+	case s.down <- err:
+	default:
+	}
+}
+
+// block until the connection is up
+// returns ctx error if ctx is done first
+func (s *Supervisor) WaitReady(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ready := s.Events.SubscribeWith(ctx, StatePolicy, TopicApiReady)
+	if s.state.Status().Up {
+		return nil
+	}
+
+	if _, ok := ready.WaitEvent(TopicApiReady); !ok {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// connection state for health checks
+func (s *Supervisor) State() ConnStatus {
+	return s.state.Status()
+}
+
+// random wait between half and all of d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		lock    sync.Mutex
+		dials   int
+		changes []bool
+	)
+
+	// fails twice then connects
+	s := NewSupervisor("Test", func(ctx context.Context) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		dials++
+		if dials <= 2 {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	s.MinBackoff = time.Millisecond
+	s.MaxBackoff = 4 * time.Millisecond
+	s.OnChange = func(up bool, err error) {
+		lock.Lock()
+		changes = append(changes, up)
+		lock.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.State(); !st.Up || st.Error != "refused" || st.Reconnects != 0 {
+		t.Errorf("state = %+v", st)
+	}
+
+	down := s.Events.Subscribe(ctx, TopicApiDown)
+	s.Down(errors.New("broken pipe"))
+
+	if e, ok := down.WaitEvent(TopicApiDown); !ok || e.Payload.(error).Error() != "broken pipe" {
+		t.Errorf("down event = %+v", e)
+	}
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.State(); !st.Up || st.Reconnects != 1 {
+		t.Errorf("state after reconnect = %+v", st)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if dials != 4 {
+		t.Errorf("dials = %d, want 4", dials)
+	}
+	if len(changes) != 3 || !changes[0] || changes[1] || !changes[2] {
+		t.Errorf("changes = %v, want [true false true]", changes)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < time.Second/2 || d > time.Second {
+			t.Fatalf("jitter = %v", d)
+		}
+	}
+}